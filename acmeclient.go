@@ -0,0 +1,156 @@
+package tlslistener
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// accountKeyName is the cache key autocert stores the ACME account key under
+const accountKeyName = "acme_account+key"
+
+// acmeClient returns a standalone ACME client configured like the manager's,
+// with the cached account key loaded if there is one. It is a copy, so using
+// it never disturbs the manager's own client.
+func (tl *TLSListener) acmeClient(ctx context.Context) (*acme.Client, error) {
+	tl.mu.RLock()
+	manager := tl.certManager
+	tl.mu.RUnlock()
+
+	if manager == nil {
+		return nil, errors.New("cert manager is not initialized")
+	}
+
+	client := &acme.Client{DirectoryURL: autocert.DefaultACMEDirectory}
+	if mc := manager.Client; mc != nil {
+		if mc.DirectoryURL != "" {
+			client.DirectoryURL = mc.DirectoryURL
+		}
+		client.HTTPClient = mc.HTTPClient
+		client.UserAgent = mc.UserAgent
+	}
+
+	key, err := loadAccountKey(ctx, manager.Cache)
+	if err != nil && err != autocert.ErrCacheMiss {
+		return nil, err
+	}
+	client.Key = key
+	return client, nil
+}
+
+// loadAccountKey reads the ACME account key from cache, returning
+// autocert.ErrCacheMiss if no account has been registered yet
+func loadAccountKey(ctx context.Context, cache autocert.Cache) (crypto.Signer, error) {
+	if cache == nil {
+		return nil, autocert.ErrCacheMiss
+	}
+	data, err := cache.Get(ctx, accountKeyName)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("invalid account key found in cache")
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse account key")
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("account key cannot sign")
+	}
+	return signer, nil
+}
+
+// CheckACME verifies that the ACME server is reachable by fetching its
+// directory and, once an account has been registered, that the account is
+// still usable. It is meant as a preflight check before taking traffic.
+func (tl *TLSListener) CheckACME(ctx context.Context) error {
+	client, err := tl.acmeClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	if _, err := client.Discover(ctx); err != nil {
+		return errors.Wrapf(err, "failed to fetch ACME directory %s", client.DirectoryURL)
+	}
+
+	if client.Key == nil {
+		// No account yet; one is registered on first issuance
+		return nil
+	}
+	if _, err := client.GetReg(ctx, ""); err != nil {
+		return errors.Wrap(err, "failed to look up ACME account")
+	}
+	return nil
+}
+
+// RotateAccountKey replaces the ACME account key with newKey using the
+// RFC 8555 key-change operation, so the account and its certificates are
+// kept, and stores newKey in the cache. newKey must be an ECDSA or RSA key.
+// If the CA refuses or does not support key rollover, the current key stays
+// in use.
+func (tl *TLSListener) RotateAccountKey(newKey crypto.Signer) error {
+	if tl.readOnly {
+		return errors.Wrap(errReadOnly, "cannot rotate account key")
+	}
+	switch newKey.(type) {
+	case *ecdsa.PrivateKey, *rsa.PrivateKey:
+	default:
+		return errors.Errorf("unsupported account key type %T", newKey)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(newKey)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode new account key")
+	}
+
+	ctx := context.Background()
+	client, err := tl.acmeClient(ctx)
+	if err != nil {
+		return err
+	}
+	if client.Key == nil {
+		return errors.New("no ACME account has been registered yet")
+	}
+
+	dir, err := client.Discover(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "failed to fetch ACME directory %s", client.DirectoryURL)
+	}
+	if dir.KeyChangeURL == "" {
+		return errors.Errorf("ACME server %s does not support account key rollover", client.DirectoryURL)
+	}
+	if err := client.AccountKeyRollover(ctx, newKey); err != nil {
+		return errors.Wrap(err, "account key rollover failed")
+	}
+
+	tl.mu.RLock()
+	cache := tl.certManager.Cache
+	certDir := tl.certDir
+	tl.mu.RUnlock()
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := cache.Put(ctx, accountKeyName, data); err != nil {
+		// The CA already knows only the new key, so say so loudly
+		return errors.Wrap(err, "account key was rotated but the new key could not be stored; keep newKey safe")
+	}
+
+	// The manager holds the old key in memory
+	tl.refreshManager(certDir)
+	return nil
+}
@@ -0,0 +1,152 @@
+package tlslistener
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme"
+)
+
+// OrderStatus describes an ACME order and the state of its authorizations
+type OrderStatus struct {
+	// URL is the order's URL at the CA
+	URL string
+	// DirectoryURL is the directory of the CA the order was placed with
+	DirectoryURL string
+	// Status is the order status: pending, ready, processing, valid or
+	// invalid
+	Status string
+	// Expires is when the CA discards the order
+	Expires time.Time
+	// Error is the problem the CA reported for the order, if any
+	Error error
+	// Authorizations lists the order's authorizations
+	Authorizations []AuthorizationStatus
+}
+
+// AuthorizationStatus describes one authorization of an ACME order
+type AuthorizationStatus struct {
+	// Identifier is the domain being authorized
+	Identifier string
+	// Status is the authorization status: pending, valid, invalid,
+	// deactivated, expired or revoked
+	Status string
+	// Challenges lists the challenges offered for the authorization
+	Challenges []ChallengeStatus
+}
+
+// ChallengeStatus describes one challenge of an authorization
+type ChallengeStatus struct {
+	// Type is the challenge type, such as tls-alpn-01 or http-01
+	Type string
+	// Status is the challenge status: pending, processing, valid or invalid
+	Status string
+	// Error is why validation failed, if it did
+	Error error
+}
+
+// acmeOrder locates the latest order placed for a domain
+type acmeOrder struct {
+	url          string
+	directoryURL string
+}
+
+// ACMEOrderStatus fetches the current state of the latest ACME order this
+// listener placed for domain, including each authorization and challenge,
+// to diagnose stuck or failed issuance. Only orders placed since startup are
+// known.
+func (tl *TLSListener) ACMEOrderStatus(ctx context.Context, domain string) (OrderStatus, error) {
+	tl.mu.RLock()
+	order, ok := tl.acmeOrders[normalizeDomain(domain)]
+	tl.mu.RUnlock()
+	if !ok {
+		return OrderStatus{}, errors.Errorf("no ACME order has been placed for %q since startup", domain)
+	}
+
+	client, err := tl.acmeClient(ctx)
+	if err != nil {
+		return OrderStatus{}, err
+	}
+	if client.Key == nil {
+		return OrderStatus{}, errors.New("no ACME account has been registered yet")
+	}
+	client.DirectoryURL = order.directoryURL
+
+	o, err := client.GetOrder(ctx, order.url)
+	if err != nil {
+		return OrderStatus{}, errors.Wrapf(err, "failed to fetch ACME order for %s", domain)
+	}
+	st := OrderStatus{
+		URL:          o.URI,
+		DirectoryURL: order.directoryURL,
+		Status:       o.Status,
+		Expires:      o.Expires,
+	}
+	if o.Error != nil {
+		st.Error = o.Error
+	}
+
+	for _, u := range o.AuthzURLs {
+		authz, err := client.GetAuthorization(ctx, u)
+		if err != nil {
+			return st, errors.Wrapf(err, "failed to fetch ACME authorization %s", u)
+		}
+		as := AuthorizationStatus{Identifier: authz.Identifier.Value, Status: authz.Status}
+		for _, ch := range authz.Challenges {
+			as.Challenges = append(as.Challenges, ChallengeStatus{Type: ch.Type, Status: ch.Status, Error: ch.Error})
+		}
+		st.Authorizations = append(st.Authorizations, as)
+	}
+	return st, nil
+}
+
+// maxOrderBodySize caps how much of a response is buffered to look for an
+// order
+const maxOrderBodySize = 1 << 20
+
+// orderRecorder is an http.RoundTripper that notes the URL of every ACME
+// order created through it, since autocert does not expose them
+type orderRecorder struct {
+	base         http.RoundTripper
+	tl           *TLSListener
+	directoryURL string
+}
+
+// RoundTrip implements http.RoundTripper
+func (r *orderRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := r.base.RoundTrip(req)
+	if err != nil || req.Method != http.MethodPost || resp.StatusCode != http.StatusCreated {
+		return resp, err
+	}
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return resp, nil
+	}
+
+	// New orders and new accounts are both answered with 201 Created; only
+	// orders carry identifiers
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxOrderBodySize))
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return resp, nil
+	}
+	var order struct {
+		Identifiers []acme.AuthzID `json:"identifiers"`
+	}
+	if json.Unmarshal(body, &order) != nil {
+		return resp, nil
+	}
+
+	r.tl.mu.Lock()
+	for _, id := range order.Identifiers {
+		r.tl.acmeOrders[normalizeDomain(id.Value)] = acmeOrder{url: location, directoryURL: r.directoryURL}
+	}
+	r.tl.mu.Unlock()
+	return resp, nil
+}
@@ -0,0 +1,118 @@
+package tlslistener
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// additionalListener is a further socket served with the listener's TLS
+// config, certificates and renewal
+type additionalListener struct {
+	tl        *TLSListener
+	ln        net.Listener
+	proxied   *proxyQueue
+	done      chan struct{}
+	mu        sync.Mutex
+	closed    bool
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// AdditionalListener listens on addr, with the same Network and
+// ControlFunc, and returns a net.Listener that serves TLS using this
+// listener's certificate manager, so certificates and renewal are shared
+// rather than duplicated. Client CIDRs, PROXY protocol, WrapConn and Stats
+// apply to it as well, but SNIErrorHandler screening does not. Closing the
+// TLSListener closes it too.
+func (tl *TLSListener) AdditionalListener(addr string) (net.Listener, error) {
+	tl.mu.RLock()
+	closed := tl.listener == nil
+	tl.mu.RUnlock()
+	if closed {
+		return nil, ErrListenerClosed
+	}
+	spec := tl.socket()
+	spec.addr = addr
+	if spec.network != "unix" {
+		if err := validateListenAddr("address", addr); err != nil {
+			return nil, err
+		}
+	}
+
+	// Bind outside the lock, which every Accept and Close also take
+	ln, err := tl.listenOn(spec)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to listen on %s", addr)
+	}
+
+	al := &additionalListener{tl: tl, ln: ln, done: make(chan struct{})}
+	if tl.proxyProtocol {
+		al.proxied = newProxyQueue(func() (*tls.Conn, error) {
+			return tl.acceptFrom(al.ln, al.isClosed)
+		}, al.done)
+	}
+
+	tl.mu.Lock()
+	if tl.listener == nil {
+		// Closed while binding
+		tl.mu.Unlock()
+		al.Close()
+		return nil, ErrListenerClosed
+	}
+	tl.additionalListeners = append(tl.additionalListeners, al)
+	tl.mu.Unlock()
+	return al, nil
+}
+
+// closeAdditionalListeners closes every listener in listeners
+func closeAdditionalListeners(listeners []*additionalListener) {
+	for _, al := range listeners {
+		al.Close()
+	}
+}
+
+// Accept implements net.Listener
+func (al *additionalListener) Accept() (net.Conn, error) {
+	if al.isClosed() {
+		return nil, ErrListenerClosed
+	}
+	var tc *tls.Conn
+	var err error
+	if al.proxied != nil {
+		tc, err = al.proxied.next()
+	} else {
+		tc, err = al.tl.acceptFrom(al.ln, al.isClosed)
+	}
+	if err != nil {
+		return nil, err
+	}
+	al.tl.observeLazily(tc)
+	return tc, nil
+}
+
+// Close implements net.Listener
+func (al *additionalListener) Close() error {
+	al.closeOnce.Do(func() {
+		al.mu.Lock()
+		al.closed = true
+		al.mu.Unlock()
+		close(al.done)
+		al.closeErr = al.ln.Close()
+	})
+	return al.closeErr
+}
+
+// Addr implements net.Listener
+func (al *additionalListener) Addr() net.Addr {
+	return al.ln.Addr()
+}
+
+// isClosed reports whether Close has been called
+func (al *additionalListener) isClosed() bool {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	return al.closed
+}
@@ -0,0 +1,39 @@
+package tlslistener
+
+import (
+	"crypto/tls"
+
+	"golang.org/x/crypto/acme"
+)
+
+// verifyALPNChallenge checks that a tls-alpn-01 validation handshake would
+// be offered the acme-tls/1 protocol, warning if the TLS config lost it
+func (tl *TLSListener) verifyALPNChallenge() {
+	hello := helloFor(tl.domain)
+	hello.SupportedProtos = []string{acme.ALPNProto}
+
+	cfg, err := tl.clientConfig(hello)
+	if err != nil {
+		tl.logf("WARNING: TLS-ALPN-01 self-check failed: %v", err)
+		return
+	}
+	if cfg == nil {
+		tl.mu.RLock()
+		cfg = tl.tlsConfig
+		tl.mu.RUnlock()
+	}
+	if !hasProto(cfg, acme.ALPNProto) {
+		tl.logf("WARNING: TLS config does not advertise %q (NextProtos %q); TLS-ALPN-01 challenges will fail",
+			acme.ALPNProto, cfg.NextProtos)
+	}
+}
+
+// hasProto reports whether cfg advertises the ALPN protocol proto
+func hasProto(cfg *tls.Config, proto string) bool {
+	for _, p := range cfg.NextProtos {
+		if p == proto {
+			return true
+		}
+	}
+	return false
+}
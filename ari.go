@@ -0,0 +1,151 @@
+package tlslistener
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme"
+)
+
+// ariTimeout bounds the directory and renewalInfo requests of one ARI check
+const ariTimeout = 30 * time.Second
+
+// renewalInfo is the ARI response body (RFC 9773)
+type renewalInfo struct {
+	SuggestedWindow struct {
+		Start time.Time `json:"start"`
+		End   time.Time `json:"end"`
+	} `json:"suggestedWindow"`
+	ExplanationURL string `json:"explanationURL"`
+}
+
+// ariShouldRenew asks the CA's renewalInfo endpoint whether domain's
+// certificate is due. As the RFC recommends, a random point inside the
+// suggested window is picked, and the certificate is due once it has passed.
+// The point is kept across checks, see ariRenewAt.
+func (tl *TLSListener) ariShouldRenew(domain string) (bool, error) {
+	leaf, err := tl.LeafCertificate(domain)
+	if err != nil {
+		return false, err
+	}
+	if len(leaf.AuthorityKeyId) == 0 {
+		return false, errors.New("certificate has no authority key identifier")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ariTimeout)
+	defer cancel()
+
+	base, err := tl.renewalInfoURL(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	// The certificate ID is base64url(AKI keyIdentifier) "." base64url(serial),
+	// with the serial in its DER form (a leading zero keeps it positive)
+	serial := leaf.SerialNumber.Bytes()
+	if len(serial) > 0 && serial[0]&0x80 != 0 {
+		serial = append([]byte{0}, serial...)
+	}
+	certID := base64.RawURLEncoding.EncodeToString(leaf.AuthorityKeyId) + "." +
+		base64.RawURLEncoding.EncodeToString(serial)
+
+	var info renewalInfo
+	if err := getJSON(ctx, tl.acmeHTTPClient(), strings.TrimSuffix(base, "/")+"/"+certID, &info); err != nil {
+		return false, errors.Wrap(err, "failed to fetch renewal info")
+	}
+
+	start, end := info.SuggestedWindow.Start, info.SuggestedWindow.End
+	if start.IsZero() || end.Before(start) {
+		return false, errors.New("renewal info has an invalid suggested window")
+	}
+	renewAt := tl.ariRenewAt(domain, certID, start, end)
+	renew := !tl.now().Before(renewAt)
+	if tl.debugRenewal {
+		tl.logf("Renewal check for %s (ARI): window=%v..%v renewAt=%v now=%v renew=%t",
+			domain, start, end, renewAt, tl.now(), renew)
+	}
+	return renew, nil
+}
+
+// ariPick is the point drawn in one certificate's suggested window
+type ariPick struct {
+	certID     string
+	start, end time.Time
+	renewAt    time.Time
+}
+
+// ariRenewAt returns the point in the window start..end at which the
+// certificate certID of domain is due. It is drawn once and reused until
+// the certificate or its window changes; drawing afresh on every check
+// would make an early point ever more likely, pulling every renewal towards
+// the start of the window the CA meant to spread them over.
+func (tl *TLSListener) ariRenewAt(domain, certID string, start, end time.Time) time.Time {
+	if v, ok := tl.ariPicks.Load(domain); ok {
+		pick := v.(ariPick)
+		if pick.certID == certID && pick.start.Equal(start) && pick.end.Equal(end) {
+			return pick.renewAt
+		}
+	}
+
+	renewAt := start
+	if window := end.Sub(start); window > 0 {
+		renewAt = start.Add(time.Duration(rand.Int63n(int64(window))))
+	}
+	tl.ariPicks.Store(domain, ariPick{certID: certID, start: start, end: end, renewAt: renewAt})
+	return renewAt
+}
+
+// renewalInfoURL looks up the renewalInfo endpoint in the ACME directory
+func (tl *TLSListener) renewalInfoURL(ctx context.Context) (string, error) {
+	directoryURL := acme.LetsEncryptURL
+	tl.mu.RLock()
+	if tl.certManager != nil && tl.certManager.Client != nil && tl.certManager.Client.DirectoryURL != "" {
+		directoryURL = tl.certManager.Client.DirectoryURL
+	}
+	tl.mu.RUnlock()
+
+	var dir struct {
+		RenewalInfo string `json:"renewalInfo"`
+	}
+	if err := getJSON(ctx, tl.acmeHTTPClient(), directoryURL, &dir); err != nil {
+		return "", errors.Wrap(err, "failed to fetch ACME directory")
+	}
+	if dir.RenewalInfo == "" {
+		return "", errors.New("CA does not support ARI")
+	}
+	return dir.RenewalInfo, nil
+}
+
+// acmeHTTPClient returns the HTTP client the manager uses to talk to the CA
+func (tl *TLSListener) acmeHTTPClient() *http.Client {
+	tl.mu.RLock()
+	defer tl.mu.RUnlock()
+	if tl.certManager != nil && tl.certManager.Client != nil && tl.certManager.Client.HTTPClient != nil {
+		return tl.certManager.Client.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// getJSON fetches url with client and decodes its JSON body into v
+func getJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("unexpected status %s from %s", resp.Status, url)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,31 @@
+package tlslistener
+
+import (
+	"testing"
+	"time"
+)
+
+func TestARIRenewAtDrawnOncePerWindow(t *testing.T) {
+	tl := &TLSListener{}
+	start := time.Now()
+	end := start.Add(48 * time.Hour)
+
+	first := tl.ariRenewAt(testDomain, "aki.01", start, end)
+	if first.Before(start) || !first.Before(end) {
+		t.Fatalf("renewAt %v outside the window %v..%v", first, start, end)
+	}
+	for i := 0; i < 20; i++ {
+		if got := tl.ariRenewAt(testDomain, "aki.01", start, end); !got.Equal(first) {
+			t.Fatalf("check %d drew %v, want the first draw %v", i, got, first)
+		}
+	}
+
+	// A new window, or a new certificate, is drawn afresh within its bounds
+	later := end.Add(24 * time.Hour)
+	if got := tl.ariRenewAt(testDomain, "aki.01", end, later); got.Before(end) || !got.Before(later) {
+		t.Fatalf("renewAt %v outside the moved window %v..%v", got, end, later)
+	}
+	if got := tl.ariRenewAt(testDomain, "aki.02", start, start); !got.Equal(start) {
+		t.Fatalf("renewAt %v for an empty window, want its start %v", got, start)
+	}
+}
@@ -0,0 +1,631 @@
+package tlslistener
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// errReadOnly is returned by every write attempted in read-only mode
+var errReadOnly = errors.New("certificate cache is read-only")
+
+// readOnlyCache wraps an autocert.Cache and refuses all writes
+type readOnlyCache struct {
+	autocert.Cache
+}
+
+func (c readOnlyCache) Put(ctx context.Context, key string, data []byte) error {
+	return errors.Wrapf(errReadOnly, "refusing to store %q", key)
+}
+
+func (c readOnlyCache) Delete(ctx context.Context, key string) error {
+	return errors.Wrapf(errReadOnly, "refusing to delete %q", key)
+}
+
+// readOnlyTransport is an http.RoundTripper that fails every request, used
+// to guarantee a read-only listener never talks to the ACME server
+type readOnlyTransport struct{}
+
+func (readOnlyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, errors.Wrapf(errReadOnly, "refusing ACME request to %s", req.URL)
+}
+
+// MigrateCertDir moves certificate storage to newDir without interrupting
+// service. Existing cache entries are copied into newDir, the certificates
+// are read back from there, and only then is a manager backed by newDir
+// swapped in for new handshakes. The old directory is left untouched.
+func (tl *TLSListener) MigrateCertDir(newDir string) error {
+	if newDir == "" {
+		return errors.New("certificate directory is required")
+	}
+	if tl.cache != nil {
+		return errors.New("cannot migrate a custom Cache")
+	}
+
+	tl.mu.RLock()
+	oldDir := tl.certDir
+	tl.mu.RUnlock()
+
+	if err := copyCacheDir(oldDir, newDir); err != nil {
+		return errors.Wrap(err, "failed to copy certificate cache")
+	}
+
+	manager := tl.newManager(newDir)
+	if err := tl.verifyMigrated(tl.managerSnap.Load().Cache, manager.Cache); err != nil {
+		return errors.Wrap(err, "failed to load certificate from new directory")
+	}
+
+	tl.mu.Lock()
+	tl.certDir = newDir
+	tl.setManager(manager)
+	tl.mu.Unlock()
+
+	return nil
+}
+
+// verifyMigrated checks that every certificate of a configured domain in
+// from reads back unchanged and usable from to. It only reads the caches, so
+// that a certificate missing from to fails the migration rather than being
+// ordered afresh.
+func (tl *TLSListener) verifyMigrated(from, to autocert.Cache) error {
+	ctx := context.Background()
+	for _, domain := range tl.domains() {
+		for _, key := range []string{domain, domain + "+rsa"} {
+			want, err := from.Get(ctx, key)
+			if err == autocert.ErrCacheMiss {
+				continue
+			} else if err != nil {
+				return errors.Wrapf(err, "failed to read %q", key)
+			}
+			got, err := to.Get(ctx, key)
+			if err != nil {
+				return errors.Wrapf(err, "failed to read %q", key)
+			}
+			if !bytes.Equal(got, want) {
+				return errors.Errorf("%q differs from the original", key)
+			}
+			if _, err := parseCacheEntry(got); err != nil {
+				return errors.Wrapf(err, "invalid certificate in %q", key)
+			}
+		}
+	}
+	return nil
+}
+
+// copyCacheDir copies every regular file in src into dst, creating dst with
+// the same 0700 permissions autocert.DirCache uses
+func copyCacheDir(src, dst string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(dst, 0700); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(src, entry.Name()))
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dst, entry.Name()), data, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ResetCache deletes the certificates of every domain this listener serves
+// and reissues them from scratch, e.g. for a key rotation drill. Only this
+// listener's own entries are removed, so the ACME account key and anything
+// else sharing CertDir, such as other services under CacheKeyFunc, are
+// kept. Handshakes for a domain stall while its certificate is reissued,
+// and fail if reissuance does; existing connections are unaffected.
+func (tl *TLSListener) ResetCache() error {
+	if tl.readOnly {
+		return errors.Wrap(errReadOnly, "cannot reset certificate cache")
+	}
+	if tl.cache != nil {
+		return errors.New("cannot reset a custom Cache")
+	}
+
+	domains := tl.domains()
+	owned := append([]string(nil), domains...)
+	tl.certDomains.Range(func(domain, _ interface{}) bool {
+		owned = append(owned, domain.(string))
+		return true
+	})
+
+	// Holding the lock keeps handshakes from picking up the old manager,
+	// with its in-memory certificates, while the entries are deleted. The
+	// manager's cache maps each key to its storage key.
+	tl.mu.Lock()
+	dir := tl.certDir
+	cache := tl.certManager.Cache
+	ctx := context.Background()
+	for _, domain := range owned {
+		for _, key := range []string{domain, domain + "+rsa"} {
+			if err := cache.Delete(ctx, key); err != nil {
+				tl.mu.Unlock()
+				return errors.Wrapf(err, "failed to remove %s", tl.storageKey(key))
+			}
+		}
+	}
+	manager := tl.newManager(dir)
+	tl.setManager(manager)
+	tl.mu.Unlock()
+
+	var firstErr error
+	for _, domain := range domains {
+		if _, err := tl.managerCertificate(manager, helloFor(domain)); err != nil {
+			tl.logf("Failed to reissue certificate for %s: %v", domain, err)
+			if firstErr == nil {
+				firstErr = errors.Wrapf(err, "failed to reissue certificate for %s", domain)
+			}
+		}
+	}
+	return firstErr
+}
+
+// HasCachedCert reports whether a certificate for domain is in the cache,
+// without ever triggering issuance. It does not check the certificate's
+// validity.
+func (tl *TLSListener) HasCachedCert(domain string) bool {
+	tl.mu.RLock()
+	manager := tl.certManager
+	tl.mu.RUnlock()
+
+	if manager == nil {
+		return false
+	}
+	return cacheHasCert(context.Background(), manager.Cache, normalizeDomain(domain))
+}
+
+// cacheHasCert reports whether cache holds a certificate for domain under
+// either of the keys autocert uses (ECDSA, or RSA for legacy clients)
+func cacheHasCert(ctx context.Context, cache autocert.Cache, domain string) bool {
+	if cache == nil {
+		return false
+	}
+	for _, key := range []string{domain, domain + "+rsa"} {
+		if _, err := cache.Get(ctx, key); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// cachedCertValid reports whether cache holds a certificate under key that
+// autocert would serve for domain rather than order afresh: by autocert's
+// rules it must match its private key, whose type must match the key's
+// "+rsa" suffix, cover domain and be within its validity period
+func (tl *TLSListener) cachedCertValid(ctx context.Context, cache autocert.Cache, key, domain string) bool {
+	if cache == nil {
+		return false
+	}
+	data, err := cache.Get(ctx, key)
+	if err != nil {
+		return false
+	}
+	cert, err := parseCacheEntry(data)
+	if err != nil {
+		return false
+	}
+	now := tl.now()
+	if now.Before(cert.Leaf.NotBefore) || now.After(cert.Leaf.NotAfter) {
+		return false
+	}
+	if cert.Leaf.VerifyHostname(domain) != nil {
+		return false
+	}
+	_, isRSA := cert.Leaf.PublicKey.(*rsa.PublicKey)
+	return isRSA == strings.HasSuffix(key, "+rsa")
+}
+
+// seedCache stores a pre-baked certificate and key in the cache for every
+// configured domain the certificate covers and that has no certificate yet,
+// so handshakes succeed before the ACME server is reachable. autocert
+// replaces it in the usual way once it falls due for renewal.
+func (tl *TLSListener) seedCache(certPEM, keyPEM []byte) error {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return errors.Wrap(err, "invalid initial certificate or key")
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return errors.Wrap(err, "failed to parse initial certificate")
+	}
+	if err := leaf.VerifyHostname(tl.domain); err != nil {
+		return errors.Wrapf(err, "initial certificate does not cover %s", tl.domain)
+	}
+	if tl.now().After(leaf.NotAfter) {
+		tl.logf("WARNING: initial certificate expired at %v and will not be served", leaf.NotAfter)
+	}
+
+	tl.mu.RLock()
+	cache := tl.certManager.Cache
+	tl.mu.RUnlock()
+
+	// autocert stores the private key followed by the chain
+	data := append(append([]byte(nil), keyPEM...), certPEM...)
+	_, isRSA := pair.PrivateKey.(*rsa.PrivateKey)
+
+	ctx := context.Background()
+	for _, domain := range tl.domains() {
+		// autocert only accepts an entry whose key type matches its key, so
+		// an RSA seed serves just the clients without ECDSA support; the
+		// others still wait for an ECDSA certificate to be issued
+		key := domain
+		if isRSA {
+			key += "+rsa"
+		}
+		if leaf.VerifyHostname(domain) != nil {
+			continue
+		}
+		if _, err := cache.Get(ctx, key); err == nil {
+			continue
+		}
+		if err := cache.Put(ctx, key, data); err != nil {
+			return errors.Wrapf(err, "failed to store initial certificate for %s", domain)
+		}
+	}
+	return nil
+}
+
+// oldCertMarker separates a cache key from the archive time of an old copy
+const oldCertMarker = "+old-"
+
+// archiveCert stores previous under an archive key if the cache entry for
+// key no longer holds it, i.e. if the certificate was actually replaced
+func (tl *TLSListener) archiveCert(cache autocert.Cache, key string, previous []byte) {
+	ctx := context.Background()
+	current, err := cache.Get(ctx, key)
+	if err == nil && bytes.Equal(current, previous) {
+		return
+	}
+
+	archiveKey := fmt.Sprintf("%s%s%d", key, oldCertMarker, tl.now().Unix())
+	if err := cache.Put(ctx, archiveKey, previous); err != nil {
+		tl.logf("Failed to archive old certificate for %s: %v", key, err)
+	}
+}
+
+// pruneOldCerts deletes archived certificates older than KeepOldCerts
+func (tl *TLSListener) pruneOldCerts() {
+	tl.mu.RLock()
+	dir := tl.certDir
+	tl.mu.RUnlock()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	cutoff := tl.now().Add(-tl.keepOldCerts)
+	for _, entry := range entries {
+		i := strings.LastIndex(entry.Name(), oldCertMarker)
+		if i < 0 {
+			continue
+		}
+		archived, err := strconv.ParseInt(entry.Name()[i+len(oldCertMarker):], 10, 64)
+		if err != nil || time.Unix(archived, 0).After(cutoff) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			tl.logf("Failed to remove old certificate %s: %v", entry.Name(), err)
+		}
+	}
+}
+
+// cacheHealth tracks the outcome of certificate cache writes
+type cacheHealth struct {
+	mu       sync.Mutex
+	lastErr  error
+	failures int
+}
+
+// reportingCache wraps an autocert.Cache so failed writes are surfaced.
+// autocert itself ignores some write errors (for example after issuance),
+// which would otherwise leave a full disk unnoticed until a restart loses
+// the renewed certificate.
+type reportingCache struct {
+	autocert.Cache
+	tl *TLSListener
+}
+
+func (c *reportingCache) Put(ctx context.Context, key string, data []byte) error {
+	if err := c.tl.validateCacheEntry(key, data); err != nil && c.tl.blockInvalid {
+		return err
+	}
+
+	err := c.Cache.Put(ctx, key, data)
+	c.tl.recordCacheWrite(key, err)
+	return err
+}
+
+// recordCacheWrite updates the cache health and loudly reports failures
+func (tl *TLSListener) recordCacheWrite(key string, err error) {
+	h := &tl.cacheHealth
+	h.mu.Lock()
+	if err == nil {
+		h.lastErr, h.failures = nil, 0
+		h.mu.Unlock()
+		return
+	}
+	h.lastErr = err
+	h.failures++
+	failures := h.failures
+	h.mu.Unlock()
+
+	tl.logf("WARNING: failed to write %q to certificate cache (%d consecutive failures); "+
+		"certificates will not survive a restart until this is fixed: %v", key, failures, err)
+	tl.renewError(key, errors.Wrap(err, "certificate cache write failed"))
+}
+
+// stagingCache wraps an autocert.Cache and keeps the staged keys to
+// itself: they read as a miss until written, and writes to them stay in
+// memory. A manager using it issues afresh without touching the cached
+// certificate, which is only replaced once the result has been checked.
+type stagingCache struct {
+	autocert.Cache
+
+	mu     sync.Mutex
+	staged map[string][]byte
+}
+
+func newStagingCache(cache autocert.Cache, keys ...string) *stagingCache {
+	staged := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		staged[key] = nil
+	}
+	return &stagingCache{Cache: cache, staged: staged}
+}
+
+func (c *stagingCache) Get(ctx context.Context, key string) ([]byte, error) {
+	c.mu.Lock()
+	data, isStaged := c.staged[key]
+	c.mu.Unlock()
+
+	if !isStaged {
+		return c.Cache.Get(ctx, key)
+	}
+	if data == nil {
+		return nil, autocert.ErrCacheMiss
+	}
+	return data, nil
+}
+
+func (c *stagingCache) Put(ctx context.Context, key string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, isStaged := c.staged[key]; !isStaged {
+		return c.Cache.Put(ctx, key, data)
+	}
+	c.staged[key] = append([]byte(nil), data...)
+	return nil
+}
+
+// result returns what was written to the staged key, or nil
+func (c *stagingCache) result(key string) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.staged[key]
+}
+
+// retire stops staging: every key reads and writes through to the wrapped
+// cache from then on
+func (c *stagingCache) retire() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.staged = nil
+}
+
+// parseCacheEntry decodes a certificate as autocert stores it, the private
+// key followed by the chain, checking that the key matches the leaf
+func parseCacheEntry(data []byte) (*tls.Certificate, error) {
+	var certPEM, keyPEM []byte
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch {
+		case block.Type == "CERTIFICATE":
+			certPEM = append(certPEM, pem.EncodeToMemory(block)...)
+		case strings.Contains(block.Type, "PRIVATE"):
+			keyPEM = pem.EncodeToMemory(block)
+		}
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	return &cert, nil
+}
+
+// syncedDirCache is an autocert.DirCache whose writes are durable.
+// DirCache already writes to a temporary file and renames it into place,
+// but without fsync a crash can still leave an empty or torn file behind
+// the new name. Put here syncs the file before the rename and the
+// directory after it.
+type syncedDirCache struct {
+	autocert.DirCache
+}
+
+func (d syncedDirCache) Put(ctx context.Context, name string, data []byte) error {
+	dir := string(d.DirCache)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dir, filepath.Base(filepath.Clean("/"+name))+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		// Like DirCache, leave the old entry alone if the caller gave up
+		return err
+	}
+
+	if err := os.Rename(tmp, filepath.Join(dir, filepath.Clean("/"+name))); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir flushes dir's entries, making a rename into it durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) {
+		return err
+	}
+	return nil
+}
+
+// keyedCache wraps an autocert.Cache and stores every entry under
+// keyFunc(key). autocert only ever addresses entries by key, so applying
+// the same transform on Get, Put and Delete keeps them consistent without
+// an inverse.
+type keyedCache struct {
+	autocert.Cache
+	keyFunc func(string) string
+}
+
+func (c keyedCache) Get(ctx context.Context, key string) ([]byte, error) {
+	return c.Cache.Get(ctx, c.keyFunc(key))
+}
+
+func (c keyedCache) Put(ctx context.Context, key string, data []byte) error {
+	return c.Cache.Put(ctx, c.keyFunc(key), data)
+}
+
+func (c keyedCache) Delete(ctx context.Context, key string) error {
+	return c.Cache.Delete(ctx, c.keyFunc(key))
+}
+
+// storageKey returns the key the backing store holds key under
+func (tl *TLSListener) storageKey(key string) string {
+	if tl.cacheKeyFunc == nil {
+		return key
+	}
+	return tl.cacheKeyFunc(key)
+}
+
+// gzipCache wraps an autocert.Cache and stores values gzip-compressed.
+// Uncompressed values, e.g. written before CompressCache was enabled, are
+// still read as they are.
+type gzipCache struct {
+	autocert.Cache
+}
+
+func (c gzipCache) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := c.Cache.Get(ctx, key)
+	if err != nil || !bytes.HasPrefix(data, gzipMagic) {
+		return data, err
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decompress %q", key)
+	}
+	defer zr.Close()
+	data, err = io.ReadAll(zr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decompress %q", key)
+	}
+	return data, nil
+}
+
+func (c gzipCache) Put(ctx context.Context, key string, data []byte) error {
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if _, err := zw.Write(data); err != nil {
+		return errors.Wrapf(err, "failed to compress %q", key)
+	}
+	if err := zw.Close(); err != nil {
+		return errors.Wrapf(err, "failed to compress %q", key)
+	}
+	return c.Cache.Put(ctx, key, buf.Bytes())
+}
+
+// gzipMagic starts every gzip stream; PEM data never does
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// memoryCache is an in-memory autocert.Cache, for tests
+type memoryCache struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func newMemoryCache() *memoryCache {
+	return &memoryCache{data: make(map[string][]byte)}
+}
+
+func (c *memoryCache) Get(ctx context.Context, key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.data[key]
+	if !ok {
+		return nil, autocert.ErrCacheMiss
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (c *memoryCache) Put(ctx context.Context, key string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data[key] = append([]byte(nil), data...)
+	return nil
+}
+
+func (c *memoryCache) Delete(ctx context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.data, key)
+	return nil
+}
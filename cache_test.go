@@ -0,0 +1,160 @@
+package tlslistener
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestSeedCacheServesECDSAClients(t *testing.T) {
+	certPEM, keyPEM := testCertPEM(t, newECDSAKey(t), time.Now().Add(-time.Hour), time.Now().Add(90*24*time.Hour), testDomain)
+	tl := newTestListener(t, Config{InitialCertPEM: certPEM, InitialKeyPEM: keyPEM})
+	serveHandshakes(tl)
+
+	// The default client config advertises ECDSA support
+	leaf, err := dialTLS(t, tl, &tls.Config{ServerName: testDomain, RootCAs: rootsFor(t, certPEM)})
+	if err != nil {
+		t.Fatalf("handshake against seeded cache failed: %v", err)
+	}
+	block, _ := pem.Decode(certPEM)
+	if !bytes.Equal(leaf.Raw, block.Bytes) {
+		t.Fatal("served certificate is not the seed")
+	}
+}
+
+func TestSeedCacheStoresRSAUnderRSAKey(t *testing.T) {
+	certPEM, keyPEM := testCertPEM(t, newRSAKey(t), time.Now().Add(-time.Hour), time.Now().Add(90*24*time.Hour), testDomain)
+	tl := newTestListener(t, Config{InitialCertPEM: certPEM, InitialKeyPEM: keyPEM})
+
+	cache := tl.managerSnap.Load().Cache
+	if _, err := cache.Get(context.Background(), testDomain); err == nil {
+		t.Fatal("RSA seed stored under the ECDSA key")
+	}
+	if _, err := cache.Get(context.Background(), testDomain+"+rsa"); err != nil {
+		t.Fatalf("RSA seed not stored under the RSA key: %v", err)
+	}
+
+	serveHandshakes(tl)
+	_, err := dialTLS(t, tl, &tls.Config{
+		ServerName:   testDomain,
+		RootCAs:      rootsFor(t, certPEM),
+		MaxVersion:   tls.VersionTLS12,
+		CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+	})
+	if err != nil {
+		t.Fatalf("RSA-only handshake against seeded cache failed: %v", err)
+	}
+}
+
+func TestSeedCacheKeepsExistingCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certPEM, keyPEM := testCertPEM(t, newECDSAKey(t), time.Now().Add(-time.Hour), time.Now().Add(90*24*time.Hour), testDomain)
+	newTestListener(t, Config{CertDir: dir, InitialCertPEM: certPEM, InitialKeyPEM: keyPEM}).Close()
+
+	otherCert, otherKey := testCertPEM(t, newECDSAKey(t), time.Now().Add(-time.Hour), time.Now().Add(90*24*time.Hour), testDomain)
+	tl := newTestListener(t, Config{CertDir: dir, InitialCertPEM: otherCert, InitialKeyPEM: otherKey})
+
+	data, err := tl.managerSnap.Load().Cache.Get(context.Background(), testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, certPEM) {
+		t.Fatal("seeding replaced an existing certificate")
+	}
+}
+
+func TestResetCacheKeepsOtherServicesEntries(t *testing.T) {
+	dir := t.TempDir()
+	prefix := func(service string) func(string) string {
+		return func(key string) string { return service + "-" + key }
+	}
+	a := newTestListener(t, Config{CertDir: dir, CacheKeyFunc: prefix("a")})
+	b := newTestListener(t, Config{CertDir: dir, CacheKeyFunc: prefix("b")})
+
+	certPEM, keyPEM := testCertPEM(t, newECDSAKey(t), time.Now().Add(-time.Hour), time.Now().Add(90*24*time.Hour), testDomain)
+	putCert(t, a, testDomain, certPEM, keyPEM)
+	putCert(t, b, testDomain, certPEM, keyPEM)
+	ctx := context.Background()
+	for _, tl := range []*TLSListener{a, b} {
+		if err := tl.managerSnap.Load().Cache.Put(ctx, accountKeyName, []byte("account")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Reissuance fails against the unreachable CA; only the deletions matter
+	a.ResetCache()
+
+	if a.HasCachedCert(testDomain) {
+		t.Fatal("ResetCache kept its own certificate")
+	}
+	if _, err := a.managerSnap.Load().Cache.Get(ctx, accountKeyName); err != nil {
+		t.Fatalf("ResetCache removed its account key: %v", err)
+	}
+	if !b.HasCachedCert(testDomain) {
+		t.Fatal("ResetCache removed another service's certificate")
+	}
+	if _, err := b.managerSnap.Load().Cache.Get(ctx, accountKeyName); err != nil {
+		t.Fatalf("ResetCache removed another service's account key: %v", err)
+	}
+}
+
+func TestMigrateCertDirCopiesCertificates(t *testing.T) {
+	tl := newTestListener(t, Config{})
+	certPEM, keyPEM := testCertPEM(t, newECDSAKey(t), time.Now().Add(-time.Hour), time.Now().Add(90*24*time.Hour), testDomain)
+	putCert(t, tl, testDomain, certPEM, keyPEM)
+
+	newDir := t.TempDir()
+	if err := tl.MigrateCertDir(newDir); err != nil {
+		t.Fatalf("MigrateCertDir: %v", err)
+	}
+	tl.mu.RLock()
+	certDir := tl.certDir
+	tl.mu.RUnlock()
+	if certDir != newDir {
+		t.Fatalf("certDir = %s, want %s", certDir, newDir)
+	}
+	data, err := autocert.DirCache(newDir).Get(context.Background(), testDomain)
+	if err != nil || !bytes.Contains(data, certPEM) {
+		t.Fatalf("certificate not copied to the new directory: %v", err)
+	}
+}
+
+func TestMigrateCertDirDoesNotOrder(t *testing.T) {
+	var requests atomic.Int32
+	ca := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer ca.Close()
+
+	// Nothing is cached yet, so loading the certificate through a manager
+	// would order one
+	tl := newTestListener(t, Config{DirectoryURL: ca.URL})
+	if err := tl.MigrateCertDir(t.TempDir()); err != nil {
+		t.Fatalf("MigrateCertDir of an empty cache: %v", err)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Fatalf("migration sent %d requests to the CA", n)
+	}
+}
+
+func TestKeepOldCertsRejectsCustomCache(t *testing.T) {
+	_, err := New(Config{
+		Domain:       testDomain,
+		Cache:        newMemoryCache(),
+		DirectoryURL: unreachableCA,
+		ListenAddr:   "127.0.0.1:0",
+		KeepOldCerts: 24 * time.Hour,
+	})
+	if err == nil {
+		t.Fatal("New accepted KeepOldCerts with a custom Cache it cannot prune")
+	}
+}
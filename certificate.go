@@ -0,0 +1,431 @@
+package tlslistener
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/idna"
+)
+
+// getCertificate implements tls.Config.GetCertificate. Internal
+// (split-horizon) domains get the internal certificate; everything else tries
+// autocert first and falls back to Config.FallbackGetCertificate, if set,
+// when autocert cannot provide a certificate.
+func (tl *TLSListener) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	// autocert only consults HostPolicy on a cache miss, so disabled domains
+	// are turned away here
+	if tl.domainDisabled(hello.ServerName) {
+		return tl.sniErrorCertificate(hello, errors.Errorf("domain %q is disabled", hello.ServerName))
+	}
+
+	if tl.internalDomains[normalizeDomain(hello.ServerName)] {
+		return tl.internalCert.Load(), nil
+	}
+	if tl.staticCert != nil {
+		return tl.staticCertificate(), nil
+	}
+
+	cert, err := tl.autocertCertificate(hello)
+	if err != nil {
+		tl.logRejectedHost(hello)
+	}
+	if err == nil || isChallengeHello(hello) {
+		return cert, err
+	}
+
+	if tl.fallbackGetCert != nil {
+		cert, fbErr := tl.fallbackGetCert(hello)
+		if fbErr == nil {
+			return cert, nil
+		}
+		err = errors.Wrapf(fbErr, "fallback certificate source failed after autocert error (%v)", err)
+	}
+	return tl.sniErrorCertificate(hello, err)
+}
+
+// getConfigForClient implements tls.Config.GetConfigForClient. It reports
+// every hello to Config.OnClientHello and lets Config.GetConfigForClient
+// pick the config for ordinary clients. ACME tls-alpn-01 validation
+// handshakes come from the CA, which never presents a client certificate,
+// so they are served without client authentication and never reach the
+// user's hook.
+func (tl *TLSListener) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if tl.onClientHello != nil {
+		tl.onClientHello(hello)
+	}
+
+	cfg, err := tl.clientConfig(hello)
+	if err != nil || !tl.disableTickets || offersTLS13(hello) {
+		return cfg, err
+	}
+
+	// The handshake will be TLS 1.2, so turn resumption off for it alone
+	if cfg == nil {
+		cfg = tl.baseConfig()
+	} else {
+		cfg = cfg.Clone()
+	}
+	cfg.SessionTicketsDisabled = true
+	return cfg, nil
+}
+
+// clientConfig returns the config to serve hello with, or nil for the
+// listener's own
+func (tl *TLSListener) clientConfig(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if tl.userConfigForClient != nil && !isChallengeHello(hello) {
+		cfg, err := tl.userConfigForClient(hello)
+		if err != nil || cfg == nil {
+			return cfg, err
+		}
+		if cfg.GetCertificate == nil && len(cfg.Certificates) == 0 {
+			// Default to the managed certificates
+			cfg = cfg.Clone()
+			cfg.GetCertificate = tl.handshakeCertificate
+		}
+		return cfg, nil
+	}
+
+	if tl.clientAuth == tls.NoClientCert || !isChallengeHello(hello) {
+		return nil, nil
+	}
+
+	challengeConfig := tl.baseConfig()
+	challengeConfig.ClientAuth = tls.NoClientCert
+	return challengeConfig, nil
+}
+
+// baseConfig returns a copy of the listener's TLS config that can be
+// returned from GetConfigForClient
+func (tl *TLSListener) baseConfig() *tls.Config {
+	cfg := tl.configSnap.Load().Clone()
+	cfg.GetConfigForClient = nil
+	return cfg
+}
+
+// offersTLS13 reports whether hello offers TLS 1.3, which the listener
+// then negotiates
+func offersTLS13(hello *tls.ClientHelloInfo) bool {
+	for _, v := range hello.SupportedVersions {
+		if v == tls.VersionTLS13 {
+			return true
+		}
+	}
+	return false
+}
+
+// autocertCertificate obtains a certificate for hello from the current manager
+func (tl *TLSListener) autocertCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	manager := tl.managerSnap.Load()
+
+	if manager == nil {
+		return nil, errors.New("cert manager is not initialized")
+	}
+
+	if isChallengeHello(hello) {
+		return tl.managerCertificate(manager, hello)
+	}
+	// autocert never orders for a certificate it holds in memory
+	keyed := tl.keyTypeHello(hello)
+	if (tl.onFirstIssue == nil && tl.approveIssuance == nil) || tl.inMemory(manager, keyed) {
+		return tl.issuedCertificate(manager, hello)
+	}
+
+	// Look in the cache before autocert does, since afterwards there is no
+	// telling a cache hit from a freshly issued certificate
+	ctx := helloContext(hello)
+	domain := normalizeDomain(hello.ServerName)
+	_, known := tl.certDomains.Load(domain)
+	firstIssue := tl.onFirstIssue != nil && !known && !cacheHasCert(ctx, manager.Cache, domain)
+
+	// autocert orders anew unless the cache holds an entry it accepts for
+	// this client. Hosts the policy turns away never reach the approver;
+	// autocert rejects them below.
+	if tl.approveIssuance != nil && !tl.cachedCertValid(ctx, manager.Cache, memoryKey(keyed), domain) &&
+		tl.hostRejected(ctx, domain) == nil {
+		if err := tl.approve(domain); err != nil {
+			return nil, err
+		}
+	}
+
+	cert, err := tl.issuedCertificate(manager, hello)
+	if err != nil {
+		return nil, err
+	}
+
+	_, alreadyKnown := tl.certDomains.LoadOrStore(domain, true)
+	if firstIssue && !alreadyKnown {
+		go tl.onFirstIssue(domain)
+	}
+	return cert, nil
+}
+
+// approve asks Config.ApproveIssuance whether a certificate may be ordered
+// for domain
+func (tl *TLSListener) approve(domain string) error {
+	if tl.approveIssuance == nil {
+		return nil
+	}
+	if err := tl.approveIssuance(domain); err != nil {
+		tl.logf("Issuance for %s was not approved: %v", domain, err)
+		return errors.Wrapf(err, "issuance of a certificate for %q was not approved", domain)
+	}
+	return nil
+}
+
+// issuedCertificate is checkedCertificate, failing over to the fallback CA
+// if the primary cannot provide the certificate
+func (tl *TLSListener) issuedCertificate(manager *autocert.Manager, hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := tl.checkedCertificate(manager, hello)
+	if err != nil {
+		return tl.fallbackCertificate(hello, err)
+	}
+	return cert, nil
+}
+
+// checkedCertificate obtains a certificate from manager, refusing one that
+// failed ValidateCertificate. autocert keeps a freshly issued certificate in
+// memory even when caching it is refused, hence the check here.
+func (tl *TLSListener) checkedCertificate(manager *autocert.Manager, hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := tl.managerCertificate(manager, hello)
+	if err != nil {
+		return nil, err
+	}
+	if tl.certRejected(cert) {
+		return nil, errors.Errorf("certificate for %q failed validation and is not served", hello.ServerName)
+	}
+	return cert, nil
+}
+
+// defaultIssuanceTimeout is used when Config.IssuanceTimeout is unset
+const defaultIssuanceTimeout = 90 * time.Second
+
+// managerCertificate calls manager.GetCertificate, giving up once the
+// issuance timeout elapses or the handshake context is done. autocert runs
+// issuance under its own context, so the call is left to finish in the
+// background rather than cancelled. Certificates the current manager already
+// holds in memory are returned directly, without the timeout machinery.
+func (tl *TLSListener) managerCertificate(manager *autocert.Manager, hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if isChallengeHello(hello) {
+		return certificateWithin(hello, tl.issuanceTimeout(), manager.GetCertificate)
+	}
+
+	hello = tl.keyTypeHello(hello)
+	if tl.inMemory(manager, hello) {
+		return manager.GetCertificate(hello)
+	}
+	cert, err := certificateWithin(hello, tl.issuanceTimeout(), manager.GetCertificate)
+	if err == nil && manager == tl.managerSnap.Load() {
+		tl.loaded.Store(memoryKey(hello), manager)
+	}
+	return cert, err
+}
+
+// issuanceTimeout returns Config.IssuanceTimeout or its default
+func (tl *TLSListener) issuanceTimeout() time.Duration {
+	if tl.issueTimeout <= 0 {
+		return defaultIssuanceTimeout
+	}
+	return tl.issueTimeout
+}
+
+// inMemory reports whether manager has already returned the certificate
+// hello asks for, so that autocert serves it from memory
+func (tl *TLSListener) inMemory(manager *autocert.Manager, hello *tls.ClientHelloInfo) bool {
+	m, ok := tl.loaded.Load(memoryKey(hello))
+	return ok && m == manager
+}
+
+// memoryKey returns the key autocert holds hello's certificate under in
+// memory: the domain, with a "+rsa" suffix for clients without ECDSA
+func memoryKey(hello *tls.ClientHelloInfo) string {
+	domain := normalizeDomain(hello.ServerName)
+	if ascii, err := idna.Lookup.ToASCII(domain); err == nil {
+		domain = ascii
+	}
+	if !supportsECDSA(hello) {
+		return domain + "+rsa"
+	}
+	return domain
+}
+
+// supportsECDSA mirrors autocert's check of whether hello can be served an
+// ECDSA certificate
+func supportsECDSA(hello *tls.ClientHelloInfo) bool {
+	if hello.SignatureSchemes != nil {
+		ecdsaOK := false
+		for _, scheme := range hello.SignatureSchemes {
+			switch scheme {
+			case tls.ECDSAWithSHA1, tls.ECDSAWithP256AndSHA256,
+				tls.ECDSAWithP384AndSHA384, tls.ECDSAWithP521AndSHA512:
+				ecdsaOK = true
+			}
+		}
+		if !ecdsaOK {
+			return false
+		}
+	}
+	if hello.SupportedCurves != nil {
+		ecdsaOK := false
+		for _, curve := range hello.SupportedCurves {
+			if curve == tls.CurveP256 {
+				ecdsaOK = true
+			}
+		}
+		if !ecdsaOK {
+			return false
+		}
+	}
+	for _, suite := range hello.CipherSuites {
+		switch suite {
+		case tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305:
+			return true
+		}
+	}
+	return false
+}
+
+// handshakeCertificate is the tls.Config.GetCertificate hook. It applies
+// Config.HandshakeCertTimeout on top of getCertificate and reports the
+// result to Config.OnCertificateServed.
+func (tl *TLSListener) handshakeCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if tl.handshakeSlots != nil && !isChallengeHello(hello) {
+		release, err := tl.acquireHandshakeSlot(hello)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+
+	var cert *tls.Certificate
+	var err error
+	if tl.handshakeCertTimeout <= 0 || tl.inMemory(tl.managerSnap.Load(), tl.keyTypeHello(hello)) {
+		cert, err = tl.getCertificate(hello)
+	} else {
+		cert, err = certificateWithin(hello, tl.handshakeCertTimeout, tl.getCertificate)
+	}
+
+	if err == nil && !isChallengeHello(hello) {
+		tl.checkServedExpiry(hello.ServerName, cert)
+		if cert != tl.sniError.cert.Load() {
+			tl.servedReady(hello.ServerName, cert)
+		}
+		if tl.onCertificateServed != nil {
+			tl.certificateServed(hello.ServerName, cert)
+		}
+	}
+	return cert, err
+}
+
+// handshakeSlotWait is how long a handshake waits for a free slot under
+// MaxConcurrentHandshakes before failing
+const handshakeSlotWait = 2 * time.Second
+
+// acquireHandshakeSlot takes one of the MaxConcurrentHandshakes slots,
+// waiting up to handshakeSlotWait, and returns the function releasing it
+func (tl *TLSListener) acquireHandshakeSlot(hello *tls.ClientHelloInfo) (func(), error) {
+	release := func() { <-tl.handshakeSlots }
+	select {
+	case tl.handshakeSlots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	timer := time.NewTimer(handshakeSlotWait)
+	defer timer.Stop()
+	select {
+	case tl.handshakeSlots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+	case <-helloContext(hello).Done():
+	}
+	return nil, errors.Errorf("too many concurrent handshakes; refusing %q", hello.ServerName)
+}
+
+// certificateServed passes the leaf of cert to Config.OnCertificateServed
+func (tl *TLSListener) certificateServed(serverName string, cert *tls.Certificate) {
+	leaf := cert.Leaf
+	if leaf == nil {
+		if len(cert.Certificate) == 0 {
+			return
+		}
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			tl.logf("Failed to parse served certificate for %q: %v", serverName, err)
+			return
+		}
+	}
+	tl.onCertificateServed(serverName, leaf)
+}
+
+// certificateWithin runs getCert for hello, returning a timeout error if it
+// has not finished within timeout or before the handshake context is done.
+// getCert keeps running in the background after a timeout.
+func certificateWithin(hello *tls.ClientHelloInfo, timeout time.Duration,
+	getCert func(*tls.ClientHelloInfo) (*tls.Certificate, error)) (*tls.Certificate, error) {
+	ctx, cancel := context.WithTimeout(helloContext(hello), timeout)
+	defer cancel()
+
+	type result struct {
+		cert *tls.Certificate
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		cert, err := getCert(hello)
+		done <- result{cert, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.cert, r.err
+	case <-ctx.Done():
+		return nil, errors.Wrapf(ctx.Err(), "timed out obtaining certificate for %q", hello.ServerName)
+	}
+}
+
+// isChallengeHello reports whether hello comes from a CA validating a
+// tls-alpn-01 challenge rather than from a real client
+func isChallengeHello(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
+
+// helloContext returns the handshake context of hello, falling back to a
+// background context for synthetic hellos built outside a handshake
+func helloContext(hello *tls.ClientHelloInfo) context.Context {
+	if ctx := hello.Context(); ctx != nil {
+		return ctx
+	}
+	return context.Background()
+}
+
+// staticLeaf returns the parsed leaf of a static certificate
+func staticLeaf(cert *tls.Certificate) (*x509.Certificate, error) {
+	if cert.Leaf != nil {
+		return cert.Leaf, nil
+	}
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("static certificate is empty")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse certificate")
+	}
+	return leaf, nil
+}
+
+// normalizeDomain lowercases name and strips any trailing dot
+func normalizeDomain(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
@@ -0,0 +1,124 @@
+package tlslistener
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// putCert stores certPEM and keyPEM under key as autocert does
+func putCert(t *testing.T, tl *TLSListener, key string, certPEM, keyPEM []byte) {
+	t.Helper()
+	data := append(append([]byte(nil), keyPEM...), certPEM...)
+	if err := tl.managerSnap.Load().Cache.Put(context.Background(), key, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApproveIssuanceSkippedForValidCache(t *testing.T) {
+	var asked atomic.Int32
+	tl := newTestListener(t, Config{ApproveIssuance: func(string) error {
+		asked.Add(1)
+		return errors.New("denied")
+	}})
+	certPEM, keyPEM := testCertPEM(t, newECDSAKey(t), time.Now().Add(-time.Hour), time.Now().Add(90*24*time.Hour), testDomain)
+	putCert(t, tl, testDomain, certPEM, keyPEM)
+
+	if _, err := tl.autocertCertificate(helloFor(testDomain)); err != nil {
+		t.Fatalf("cached certificate not served: %v", err)
+	}
+	if n := asked.Load(); n != 0 {
+		t.Fatalf("approver consulted %d times for a cache hit", n)
+	}
+}
+
+func TestApproveIssuanceGatesUnusableCache(t *testing.T) {
+	tests := []struct {
+		name  string
+		store func(t *testing.T, tl *TLSListener)
+	}{
+		{"expired", func(t *testing.T, tl *TLSListener) {
+			certPEM, keyPEM := testCertPEM(t, newECDSAKey(t), time.Now().Add(-48*time.Hour), time.Now().Add(-time.Hour), testDomain)
+			putCert(t, tl, testDomain, certPEM, keyPEM)
+		}},
+		{"RSA only", func(t *testing.T, tl *TLSListener) {
+			certPEM, keyPEM := testCertPEM(t, newRSAKey(t), time.Now().Add(-time.Hour), time.Now().Add(90*24*time.Hour), testDomain)
+			putCert(t, tl, testDomain+"+rsa", certPEM, keyPEM)
+		}},
+		{"other domain", func(t *testing.T, tl *TLSListener) {
+			certPEM, keyPEM := testCertPEM(t, newECDSAKey(t), time.Now().Add(-time.Hour), time.Now().Add(90*24*time.Hour), "other.example.org")
+			putCert(t, tl, testDomain, certPEM, keyPEM)
+		}},
+		{"known domain, empty cache", func(t *testing.T, tl *TLSListener) {
+			tl.certDomains.Store(testDomain, true)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var asked atomic.Int32
+			tl := newTestListener(t, Config{ApproveIssuance: func(string) error {
+				asked.Add(1)
+				return errors.New("denied")
+			}})
+			tt.store(t, tl)
+
+			_, err := tl.autocertCertificate(helloFor(testDomain))
+			if err == nil || !strings.Contains(err.Error(), "not approved") {
+				t.Fatalf("got %v, want an approval error", err)
+			}
+			if n := asked.Load(); n != 1 {
+				t.Fatalf("approver consulted %d times, want 1", n)
+			}
+		})
+	}
+}
+
+func TestManagerRenewsOnlyAsLastResort(t *testing.T) {
+	tl := newTestListener(t, Config{})
+	if got := tl.managerSnap.Load().RenewBefore; got != lastResortRenewBefore {
+		t.Fatalf("autocert RenewBefore = %v, want %v", got, lastResortRenewBefore)
+	}
+}
+
+func TestStaticCertificateHandshakeTakesNoLock(t *testing.T) {
+	certPEM, keyPEM := testCertPEM(t, newECDSAKey(t), time.Now().Add(-time.Hour), time.Now().Add(90*24*time.Hour), testDomain)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl := newTestListener(t, Config{Certificate: &cert})
+	serveHandshakes(tl)
+
+	// Accepting takes the lock, so the connection is accepted first
+	raw, err := net.Dial("tcp", tl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	waitFor(t, "the connection to be accepted", func() bool { return tl.Stats().Accepted == 1 })
+
+	// Stand in for Rebind or AdditionalListener holding the lock across a
+	// slow syscall
+	roots := rootsFor(t, certPEM)
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	done := make(chan error, 1)
+	go func() {
+		raw.SetDeadline(time.Now().Add(5 * time.Second))
+		done <- tls.Client(raw, &tls.Config{ServerName: testDomain, RootCAs: roots}).Handshake()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("a static-certificate handshake waited on the listener's lock")
+	}
+}
@@ -0,0 +1,46 @@
+package tlslistener
+
+import (
+	"crypto/x509"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// VerifyClientCert verifies a client certificate chain against
+// Config.ClientCAs outside of a handshake, e.g. to re-check a client after a
+// CA rotation. chain holds DER certificates, leaf first, as found in
+// tls.ConnectionState.PeerCertificates or tls.Certificate.Certificate.
+func (tl *TLSListener) VerifyClientCert(chain [][]byte) error {
+	if tl.clientCAs == nil {
+		return errors.New("no client CAs configured")
+	}
+	if len(chain) == 0 {
+		return errors.New("client certificate chain is empty")
+	}
+
+	certs := make([]*x509.Certificate, len(chain))
+	for i, der := range chain {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse client certificate %d", i)
+		}
+		certs[i] = cert
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         tl.clientCAs,
+		Intermediates: intermediates,
+		CurrentTime:   time.Now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if _, err := certs[0].Verify(opts); err != nil {
+		return errors.Wrapf(err, "client certificate %q failed verification", certs[0].Subject)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package tlslistener
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// conn wraps a raw accepted connection, underneath the TLS layer, so the
+// listener can enforce per-connection policies
+type conn struct {
+	net.Conn
+	tl *TLSListener
+
+	idleTimeout time.Duration
+	idleTimer   *time.Timer
+	acceptedAt  time.Time
+
+	closeOnce sync.Once
+	closeErr  error
+
+	// sniRejected marks a connection for SNIErrorHandler
+	sniRejected atomic.Bool
+
+	// observe, if set, is started on the first read, which only the TLS
+	// handshake makes
+	observe     func()
+	observeOnce sync.Once
+
+	// br buffers reads when a PROXY protocol header is expected
+	br        *bufio.Reader
+	proxyOnce sync.Once
+	proxyRead atomic.Bool
+	proxyAddr net.Addr
+	proxyErr  error
+}
+
+// wrapConn applies the listener's per-connection policies to c
+func (tl *TLSListener) wrapConn(c net.Conn) net.Conn {
+	if tcpConn, ok := c.(*net.TCPConn); ok && tl.tcpKeepAlive > 0 {
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(tl.tcpKeepAlive)
+	}
+
+	// The user's wrapper sits between the raw connection and ours, so it
+	// sees the bytes on the wire while ours stays directly beneath TLS
+	if tl.userWrapConn != nil {
+		c = tl.userWrapConn(c)
+	}
+
+	wc := &conn{
+		Conn:        c,
+		tl:          tl,
+		idleTimeout: tl.idleTimeout,
+		acceptedAt:  time.Now(),
+	}
+	if tl.proxyProtocol {
+		wc.br = bufio.NewReader(c)
+	}
+	if wc.idleTimeout > 0 {
+		// A timer rather than SetDeadline, so deadlines set by the caller
+		// (e.g. http.Server's ReadTimeout) are left untouched
+		wc.idleTimer = time.AfterFunc(wc.idleTimeout, func() {
+			wc.Close()
+		})
+	}
+
+	tl.connMu.Lock()
+	tl.conns[wc] = struct{}{}
+	tl.connMu.Unlock()
+	return wc
+}
+
+// closeConns closes every connection that is still open
+func (tl *TLSListener) closeConns() {
+	tl.connMu.Lock()
+	conns := make([]*conn, 0, len(tl.conns))
+	for c := range tl.conns {
+		conns = append(conns, c)
+	}
+	tl.connMu.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// touch records activity on the connection, pushing back the idle timer
+func (c *conn) touch() {
+	if c.idleTimer != nil {
+		c.idleTimer.Reset(c.idleTimeout)
+	}
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	c.touch()
+	defer c.touch()
+
+	if c.observe != nil {
+		c.observeOnce.Do(func() { go c.observe() })
+	}
+
+	if c.br == nil {
+		return c.Conn.Read(b)
+	}
+	if err := c.proxyHeader(); err != nil {
+		return 0, err
+	}
+	return c.br.Read(b)
+}
+
+// RemoteAddr returns the client address, as declared by the PROXY protocol
+// header when Config.ProxyProtocol is set. It never blocks; Accept only
+// hands out connections whose header has been read.
+func (c *conn) RemoteAddr() net.Addr {
+	if c.br != nil && c.proxyRead.Load() && c.proxyAddr != nil {
+		return c.proxyAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	c.touch()
+	n, err := c.Conn.Write(b)
+	c.touch()
+	return n, err
+}
+
+func (c *conn) Close() error {
+	c.closeOnce.Do(func() {
+		if c.idleTimer != nil {
+			c.idleTimer.Stop()
+		}
+		c.closeErr = c.Conn.Close()
+		c.tl.stats.closed.Add(1)
+
+		c.tl.connMu.Lock()
+		delete(c.tl.conns, c)
+		c.tl.connMu.Unlock()
+	})
+	return c.closeErr
+}
+
+// NetConn returns the underlying connection, mirroring tls.Conn.NetConn
+func (c *conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// observeLazily arranges for the outcome of tc's handshake to be recorded
+// once the caller starts it, with its first Read, Write or Handshake. The
+// handshake stays under the caller's deadlines and context, and a client
+// that never gets that far costs nothing.
+func (tl *TLSListener) observeLazily(tc *tls.Conn) {
+	if c, ok := tc.NetConn().(*conn); ok {
+		c.observe = func() { tl.observeHandshake(tc) }
+	}
+}
+
+// observeHandshake records the outcome of tc's handshake, which the caller
+// has started: Handshake waits for the one under way and returns its result
+func (tl *TLSListener) observeHandshake(tc *tls.Conn) {
+	tl.handshakeDone(tc, tc.Handshake())
+}
+
+// handshakeDone records the outcome of tc's handshake, reporting its
+// duration since accept to Config.OnHandshakeComplete
+func (tl *TLSListener) handshakeDone(tc *tls.Conn, err error) {
+	if err != nil {
+		tl.stats.handshakeFailures.Add(1)
+		return
+	}
+	if tl.onHandshakeComplete == nil {
+		return
+	}
+	if c, ok := tc.NetConn().(*conn); ok {
+		tl.onHandshakeComplete(time.Since(c.acceptedAt), tc.ConnectionState().ServerName)
+	}
+}
+
+// UsedEarlyData reports whether the TLS connection c, as returned by Accept,
+// accepted TLS 1.3 early data (0-RTT). crypto/tls never accepts early data
+// on the server side, so this currently always returns false; it exists so
+// callers can guard replay-sensitive handling today and keep working
+// unchanged once support lands.
+func UsedEarlyData(c net.Conn) bool {
+	return false
+}
@@ -0,0 +1,114 @@
+package tlslistener
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it holds or a second has passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHandshakeObservedOnlyOnceCallerStartsIt(t *testing.T) {
+	cert := testCert(t, testDomain)
+	var completed atomic.Int32
+	tl := newTestListener(t, Config{
+		Certificate:         cert,
+		OnHandshakeComplete: func(time.Duration, string) { completed.Add(1) },
+	})
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	clientDone := make(chan error, 1)
+	go func() {
+		c, err := tls.Dial("tcp", tl.Addr().String(), &tls.Config{ServerName: testDomain, RootCAs: roots})
+		if err == nil {
+			c.Close()
+		}
+		clientDone <- err
+	}()
+
+	c, err := tl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The client has sent its hello, but nothing may answer it before the
+	// caller starts the handshake
+	time.Sleep(100 * time.Millisecond)
+	if n := completed.Load(); n != 0 {
+		t.Fatalf("handshake completed %d times before the caller started it", n)
+	}
+
+	if err := c.(*tls.Conn).Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-clientDone; err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "OnHandshakeComplete", func() bool { return completed.Load() == 1 })
+}
+
+func TestHandshakeFollowsCallerContext(t *testing.T) {
+	tl := newTestListener(t, Config{Certificate: testCert(t, testDomain)})
+
+	// A client that connects but never sends a hello
+	silent, err := net.Dial("tcp", tl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	c, err := tl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := c.(*tls.Conn).HandshakeContext(ctx); err == nil {
+		t.Fatal("handshake with a silent client succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("handshake ignored the caller's context for %v", elapsed)
+	}
+	waitFor(t, "the failure to be counted", func() bool { return tl.Stats().HandshakeFailures == 1 })
+}
+
+func TestUnreadConnectionIsNotHandshaken(t *testing.T) {
+	tl := newTestListener(t, Config{Certificate: testCert(t, testDomain)})
+
+	silent, err := net.Dial("tcp", tl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	c, err := tl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	time.Sleep(50 * time.Millisecond)
+	if st := tl.Stats(); st.HandshakeFailures != 0 || st.Closed != 1 {
+		t.Fatalf("stats %+v: an unread connection was handshaken", st)
+	}
+}
@@ -1,14 +1,25 @@
 package tlslistener
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
 	"fmt"
 	"net"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
 )
 
@@ -17,14 +28,158 @@ import (
  * it is named for ACME's most famous customer, wile e. coyote, super genius.
  */
 
+// ErrListenerClosed is returned by Accept once the listener has been closed,
+// including to any Accept calls that were blocked at the time of Close
+var ErrListenerClosed = errors.New("listener is closed")
+
 type TLSListener struct {
-	mu             sync.RWMutex
-	listener       net.Listener
-	certManager    *autocert.Manager
-	domain         string
-	certDir        string
-	email          string
-	allowedDomains []string
+	mu              sync.RWMutex
+	listener        net.Listener
+	tlsConfig       *tls.Config
+	certManager     *autocert.Manager
+	domain          string
+	certDir         string
+	email           string
+	allowedDomains  []string
+	readOnly        bool
+	idleTimeout     time.Duration
+	renewAfter      time.Duration
+	renewMargin     time.Duration
+	renewBefore     time.Duration
+	onFirstIssue    func(domain string)
+	issueTimeout    time.Duration
+	fallbackGetCert func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	domainMargins   map[string]time.Duration
+	clientCAs       *x509.CertPool
+	clientAuth      tls.ClientAuthType
+	internalDomains map[string]bool
+	internalCert    atomic.Pointer[tls.Certificate]
+	// internalHosts is set when internalCert was generated for them
+	internalHosts []string
+	useARI        bool
+	// nowFunc returns the current time for renewal decisions. It is
+	// time.Now outside of tests, which may replace it to control the clock.
+	nowFunc func() time.Time
+	// draining is set by Drain: the base listener is closed but accepted
+	// connections are left to finish
+	draining bool
+	connMu   sync.Mutex
+	conns    map[*conn]struct{}
+	// http01 is set once HTTPHandler has been called, so managers created
+	// later also offer the http-01 challenge
+	http01               atomic.Bool
+	onClientHello        func(*tls.ClientHelloInfo)
+	keepOldCerts         time.Duration
+	mustStaple           bool
+	tcpKeepAlive         time.Duration
+	handshakeCertTimeout time.Duration
+	disableHTTP2         bool
+	onRenewError         func(domain string, err error)
+	cacheHealth          cacheHealth
+	allowedCIDRs         []*net.IPNet
+	// lastRenewal holds when each domain last renewed successfully
+	lastRenewal   map[string]time.Time
+	controlFunc   func(network, address string, c syscall.RawConn) error
+	directoryURL  string
+	acmeTLSConfig *tls.Config
+	cache         autocert.Cache
+	// ownsListener is set when wileedot created the base listener itself
+	ownsListener bool
+	// ownsBase is set unless Config.KeepBaseListenerOpen leaves
+	// BaseListener to the caller
+	ownsBase bool
+	// done is closed by Close to stop the renewal routine
+	done                 chan struct{}
+	stopOnce             sync.Once
+	renewalLeaseTTL      time.Duration
+	leaseOwner           string
+	disabledDomains      map[string]bool
+	logger               Logger
+	logRejectedHosts     bool
+	rejectLog            rejectLogLimiter
+	onPanic              func(interface{})
+	onCertificateServed  func(serverName string, cert *x509.Certificate)
+	lastRenewalErr       error
+	minValidity          time.Duration
+	healthRenewing       atomic.Bool
+	jsonLogs             bool
+	shouldRenewFunc      func(info CertInfo) bool
+	network              string
+	listenAddr           string
+	staticCert           *tls.Certificate
+	sniErrorHandler      http.Handler
+	sniError             sniErrorState
+	rateLimitedUntil     time.Time
+	httpChallengeAddr    string
+	challengeListener    net.Listener
+	challengeServers     []*http.Server
+	userWrapConn         func(net.Conn) net.Conn
+	fallbackDirectoryURL string
+	fallbackEAB          *acme.ExternalAccountBinding
+	primaryFailures      atomic.Int32
+	issuingCA            map[string]string
+	renewalPaused        atomic.Bool
+	proxyProtocol        bool
+	maxDomains           int
+	orderedDomains       map[string]bool
+	compressCache        bool
+	onHandshakeComplete  func(d time.Duration, serverName string)
+	debugRenewal         bool
+	skipStartupCheck     bool
+	validateCert         func(*x509.Certificate) error
+	blockInvalid         bool
+	rejectedSerials      map[string]bool
+	userAgent            string
+	userConfigForClient  func(*tls.ClientHelloInfo) (*tls.Config, error)
+	domainsFile          string
+	configDomains        []string
+	includeWWW           bool
+	whitelist            autocert.HostPolicy
+	ocspInterval         time.Duration
+	approveIssuance      func(domain string) error
+	acmeOrders           map[string]acmeOrder
+	extraExtensions      []pkix.Extension
+	metricsLabels        map[string]string
+	disableTickets       bool
+	additionalListeners  []*additionalListener
+	cacheKeyFunc         func(key string) string
+	fileDomains          []string
+	addedDomains         []string
+	onServingExpired     func(domain string, expiredSince time.Duration)
+	expiredNotified      map[string]time.Time
+	lastExpiredServed    time.Time
+	handshakeSlots       chan struct{}
+	atomicCache          bool
+	onRenewalCheck       func(shouldRenew bool, err error)
+	ready                chan struct{}
+	readyOnce            sync.Once
+	domainKeyTypes       map[string]KeyType
+	proxied              *proxyQueue
+	// certDomains records domains known to have a certificate, so the
+	// first-issue check only has to consult the cache once per domain
+	certDomains sync.Map
+	// loaded records, by memoryKey, the manager that last returned each
+	// certificate, which autocert then serves from memory
+	loaded sync.Map
+	// rebindMu serializes Rebind, which binds outside mu
+	rebindMu sync.Mutex
+	// fallbackOrders holds the domains being ordered from the fallback CA
+	// on demand
+	fallbackOrders sync.Map
+	// ariPicks records, by domain, the point drawn in the ARI window of its
+	// current certificate
+	ariPicks sync.Map
+
+	stats listenerStats
+
+	// managerSnap and configSnap mirror certManager and tlsConfig for the
+	// per-handshake path, so busy servers do not contend on mu there
+	managerSnap atomic.Pointer[autocert.Manager]
+	configSnap  atomic.Pointer[tls.Config]
+	// servedStatic is the static certificate with its latest OCSP staple
+	servedStatic atomic.Pointer[tls.Certificate]
+	// anyDisabled is set while disabledDomains is non-empty
+	anyDisabled atomic.Bool
 }
 
 type Config struct {
@@ -37,9 +192,327 @@ type Config struct {
 	// Email is the contact email for Let's Encrypt
 	Email string
 	// BaseListener is an optional existing listener to wrap with TLS
-	// If nil, a new TCP listener on :443 will be created
+	// If nil, a new listener is created from Network and ListenAddr
 	BaseListener net.Listener
+	// KeepBaseListenerOpen leaves BaseListener to the caller: Close and
+	// Drain stop handing out its connections but do not close it, so
+	// blocked Accept calls only return once the caller closes it. By
+	// default Close and Drain close it like any other listener.
+	KeepBaseListenerOpen bool
+	// Network is the network to listen on: "tcp" (the default), "tcp4",
+	// "tcp6", or "unix". A unix socket cannot answer ACME challenges, so
+	// it requires Certificate.
+	Network string
+	// ListenAddr is the address to listen on, or the socket path for
+	// "unix". Defaults to ":443". Ignored when BaseListener is set.
+	ListenAddr string
+	// Certificate is a static certificate served for every domain instead
+	// of ACME-managed ones. Nothing is issued or renewed while it is set.
+	Certificate *tls.Certificate
+	// ReadOnlyCache serves certificates from CertDir without ever contacting
+	// the ACME server. A cache miss fails the handshake instead of ordering a
+	// new certificate, and the renewal routine is disabled. Use this for
+	// replicas that share a cache populated by a single "leader" instance.
+	ReadOnlyCache bool
+	// IdleTimeout closes an accepted connection once no Read or Write has
+	// happened on it for this long. Zero disables idle reaping.
+	IdleTimeout time.Duration
+	// RenewAfter renews a certificate once it is at least this old
+	// (measured from NotBefore). Defaults to two months.
+	RenewAfter time.Duration
+	// RenewSafetyMargin renews a certificate once it is within this long of
+	// expiring, regardless of its age. Defaults to 30 days.
+	// A certificate is renewed as soon as either condition is met.
+	RenewSafetyMargin time.Duration
+	// DomainRenewBefore overrides RenewSafetyMargin for individual domains,
+	// e.g. to renew a business-critical name earlier than the rest
+	DomainRenewBefore map[string]time.Duration
+	// RenewBefore switches to expiry-only renewal: a certificate is renewed
+	// once it is within this long of expiring, and RenewAfter's age rule is
+	// ignored. Suits short-lived certificates. DomainRenewBefore still
+	// applies per domain.
+	RenewBefore time.Duration
+	// OnFirstIssue is called, in its own goroutine, when a certificate is
+	// obtained for a domain that had nothing in the cache beforehand
+	OnFirstIssue func(domain string)
+	// IssuanceTimeout bounds how long obtaining a certificate may take,
+	// including ACME order and authorization polling. A handshake that would
+	// wait longer fails with a timeout error instead of hanging; issuance
+	// carries on in the background and later handshakes pick up the result.
+	// Defaults to 90 seconds.
+	IssuanceTimeout time.Duration
+	// FallbackGetCertificate is consulted whenever autocert fails to provide
+	// a certificate, e.g. for a domain outside AllowedDomains. Use it to
+	// combine ACME certificates with another certificate source.
+	FallbackGetCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+	// ClientCAs is the pool of CAs used to verify client certificates
+	ClientCAs *x509.CertPool
+	// ClientAuth is the client certificate policy for mTLS. It is never
+	// applied to tls-alpn-01 validation handshakes, which come from the CA.
+	ClientAuth tls.ClientAuthType
+	// InternalDomains are served with InternalCertificate instead of an ACME
+	// certificate, for split-horizon names that only resolve inside the
+	// network and so can never pass ACME validation
+	InternalDomains []string
+	// InternalCertificate is served for InternalDomains. If nil, a
+	// self-signed certificate covering InternalDomains is generated.
+	InternalCertificate *tls.Certificate
+	// UseARI asks the CA's ACME Renewal Information (ARI) endpoint when to
+	// renew, instead of using the RenewAfter/RenewSafetyMargin heuristic. The
+	// heuristic is still used whenever ARI is unavailable.
+	UseARI bool
+	// OnClientHello is called with every ClientHello received, e.g. for
+	// fingerprinting or SNI anomaly detection. It cannot abort the handshake.
+	// It runs synchronously on the handshake path, so it should return
+	// quickly and hand any heavy processing off to another goroutine.
+	OnClientHello func(*tls.ClientHelloInfo)
+	// KeepOldCerts keeps the previous certificate in CertDir for this long
+	// after it is replaced by a renewal, for debugging and manual rollback.
+	// Archived copies are named "<domain>+old-<unix time>". Zero disables it.
+	// It cannot be combined with a custom Cache.
+	KeepOldCerts time.Duration
+	// MustStaple requests certificates carrying the OCSP Must-Staple TLS
+	// feature (RFC 7633). Clients that honour it hard-fail whenever a valid
+	// OCSP staple is missing, so a stapling outage breaks connections. Not
+	// every CA supports it; Let's Encrypt no longer does.
+	MustStaple bool
+	// TCPKeepAlive enables TCP keep-alives with this period on accepted
+	// connections. It requires a TCP listener: a non-TCP BaseListener is
+	// rejected by New. Zero leaves the listener's defaults alone.
+	TCPKeepAlive time.Duration
+	// HandshakeCertTimeout bounds how long a single handshake may wait for
+	// its certificate, covering every source (cache, issuance, fallback). The
+	// handshake is aborted with a timeout error when exceeded. Zero means
+	// only IssuanceTimeout applies.
+	HandshakeCertTimeout time.Duration
+	// DisableHTTP2 stops advertising h2 via ALPN so clients fall back to
+	// HTTP/1.1. The acme-tls/1 protocol stays advertised for tls-alpn-01.
+	DisableHTTP2 bool
+	// OnRenewError is called when checking or renewing a domain's certificate
+	// fails, and when a write to the certificate cache fails (in which case
+	// domain is the cache key), so operators can alert before an outage
+	OnRenewError func(domain string, err error)
+	// AllowedClientCIDRs restricts which client addresses may connect, e.g.
+	// "10.0.0.0/8" or "2001:db8::/32". Connections from elsewhere are
+	// closed in Accept before any TLS handshake. Empty allows everyone.
+	AllowedClientCIDRs []string
+	// ControlFunc is passed to net.ListenConfig when wileedot creates its own
+	// listener, for socket options such as TCP_FASTOPEN or buffer sizes.
+	// It is ignored when BaseListener is set.
+	ControlFunc func(network, address string, c syscall.RawConn) error
+	// RebindGracePeriod is how long Rebind keeps the old socket open once
+	// the new one is in place, so Accept calls already waiting on it can
+	// still take the connections queued in its backlog. Zero closes it at
+	// once. Only Rebind reads it.
+	RebindGracePeriod time.Duration
+	// DirectoryURL is the ACME directory to use. Defaults to Let's Encrypt.
+	DirectoryURL string
+	// ACMETLSConfig is the TLS configuration for talking to the ACME server,
+	// e.g. to trust a test CA such as pebble
+	ACMETLSConfig *tls.Config
+	// Cache replaces the CertDir directory cache with a custom store.
+	// CertDir is not required when Cache is set.
+	Cache autocert.Cache
+	// IncludeWWW also allows the "www." counterpart of Domain and every
+	// AllowedDomains entry: example.com adds www.example.com, and
+	// www.example.com adds example.com
+	IncludeWWW bool
+	// Allow0RTT requests TLS 1.3 early data (0-RTT). Early data can be
+	// replayed by an attacker, so it must only ever carry idempotent requests.
+	// crypto/tls does not implement server-side early data, so for now this
+	// only logs a warning at startup; clients fall back to a normal 1-RTT
+	// handshake (with session resumption) and UsedEarlyData reports false.
+	Allow0RTT bool
+	// RenewalLeaseTTL, if set, coordinates renewal between instances sharing
+	// a cache: an instance must hold a lease stored in the cache to renew a
+	// domain, and the others pick up the renewed certificate from the cache.
+	// The lease expires after this long in case its holder dies mid-renewal.
+	// autocert's own renewal timers sit outside the lease, but only fire
+	// within about an hour of expiry, by which time the renewal routine
+	// has normally renewed long since.
+	RenewalLeaseTTL time.Duration
+	// Logger receives the listener's log output. Defaults to stdout.
+	Logger Logger
+	// LogRejectedHosts logs handshakes whose SNI hostname the host policy
+	// rejects, with the client address, rate-limited against scanners
+	LogRejectedHosts bool
+	// InitialCertPEM and InitialKeyPEM seed the cache with a pre-baked
+	// certificate for offline bootstrap. They are only written for domains
+	// with no cached certificate, and ACME takes over at renewal time. Use
+	// an ECDSA certificate: autocert serves an RSA one only to clients
+	// without ECDSA support.
+	InitialCertPEM []byte
+	InitialKeyPEM  []byte
+	// OnPanic is called with the recovered value if a renewal check panics.
+	// The panic is logged either way and renewal carries on.
+	OnPanic func(interface{})
+	// OnCertificateServed is called during each handshake with the SNI name
+	// and the leaf certificate about to be served, e.g. for audit trails.
+	// It runs on the handshake path and should return quickly.
+	OnCertificateServed func(serverName string, cert *x509.Certificate)
+	// MinRemainingValidity is the least validity the primary certificate may
+	// have left. New renews first if it falls short, failing if that does
+	// not help, and Healthy reports an error while it falls short.
+	MinRemainingValidity time.Duration
+	// JSONLogs writes the default log output as one JSON object per line,
+	// with ts, level, msg and domain fields. Ignored when Logger is set.
+	JSONLogs bool
+	// ShouldRenewFunc, if set, decides whether a certificate is due for
+	// renewal in place of the built-in heuristics (including UseARI). It is
+	// called from the daily renewal check.
+	ShouldRenewFunc func(info CertInfo) bool
+	// SNIErrorHandler, if set, serves clients asking for a domain we have no
+	// certificate for: the handshake completes with a self-signed fallback
+	// certificate and the request is answered by this handler instead of
+	// failing with a TLS error. Accept then only returns connections whose
+	// handshake has completed.
+	SNIErrorHandler http.Handler
+	// HTTPChallengeAddr is where ServeHTTPChallenges listens for http-01
+	// challenges. Defaults to ":80"; set it to bind a specific interface.
+	HTTPChallengeAddr string
+	// HTTPChallengeListener, if set, is a pre-bound listener that
+	// ServeHTTPChallenges serves on instead of binding HTTPChallengeAddr,
+	// e.g. one passed in by systemd socket activation so that the process
+	// needs no privileges for port 80. Close stops that server, closing it.
+	HTTPChallengeListener net.Listener
+	// WrapConn, if set, wraps every accepted connection, e.g. for bandwidth
+	// accounting or tracing. It is applied beneath TLS, so it sees encrypted
+	// bytes and Accept still returns a *tls.Conn, which net/http needs for
+	// HTTP/2 and Request.TLS.
+	WrapConn func(net.Conn) net.Conn
+	// FallbackDirectoryURL is a secondary ACME CA, e.g. ZeroSSL, that
+	// renewal and on-demand issuance fail over to when the primary CA keeps
+	// failing or rate-limits us
+	FallbackDirectoryURL string
+	// FallbackExternalAccountBinding holds the EAB credentials the fallback
+	// CA requires, if any
+	FallbackExternalAccountBinding *acme.ExternalAccountBinding
+	// ProxyProtocol expects every connection to start with a PROXY protocol
+	// (v1 or v2) header, as sent by HAProxy or a cloud load balancer, and
+	// reports the client address it declares from RemoteAddr, and so in
+	// http.Request.RemoteAddr. AllowedClientCIDRs still applies to the
+	// proxy's address. Connections without a valid header are rejected.
+	ProxyProtocol bool
+	// MaxDomains caps how many distinct domains certificates will be
+	// ordered for, as a safety valve against SNI floods when many domains
+	// are allowed. Zero means no limit.
+	MaxDomains int
+	// CompressCache stores cache entries gzip-compressed, for constrained
+	// storage. Entries written uncompressed are still read.
+	CompressCache bool
+	// OnHandshakeComplete is called after each successful handshake with the
+	// time taken since the connection was accepted and the SNI name, e.g. to
+	// feed a latency histogram. Slow outliers usually mean on-demand
+	// issuance.
+	OnHandshakeComplete func(d time.Duration, serverName string)
+	// DebugRenewal logs every renewal decision along with its inputs
+	// (validity, current time and thresholds), for tuning renewal windows
+	DebugRenewal bool
+	// DisableStartupRenewalCheck skips the renewal check the renewal
+	// routine otherwise runs as soon as the listener starts, leaving the
+	// first check for a day later
+	DisableStartupRenewalCheck bool
+	// ValidateCertificate is called with the leaf of every newly obtained
+	// certificate, e.g. to check its SANs or issuer. An error is logged and
+	// passed to OnRenewError.
+	ValidateCertificate func(*x509.Certificate) error
+	// BlockInvalidCertificates refuses to cache or serve certificates that
+	// fail ValidateCertificate; a failed renewal keeps the old certificate
+	BlockInvalidCertificates bool
+	// UserAgent is prepended to the User-Agent of ACME requests, so the CA
+	// can attribute traffic to your application
+	UserAgent string
+	// GetConfigForClient, if set, may return a different TLS config per
+	// client hello, e.g. to require client certificates for some domains
+	// only. Returning nil keeps the default config. A returned config
+	// without certificates serves the managed ones. ACME tls-alpn-01
+	// challenge handshakes never reach it, so it cannot break validation.
+	GetConfigForClient func(*tls.ClientHelloInfo) (*tls.Config, error)
+	// DomainsFile names a file listing further allowed domains, one per
+	// line with "#" comments. It is polled for changes, which take effect
+	// without a restart; invalid entries are skipped with a warning.
+	DomainsFile string
+	// VerifyDNS resolves every allowed domain in New and fails if one does
+	// not resolve at all. A domain none of whose addresses belongs to a
+	// local interface only logs a warning, since hosts behind NAT or a load
+	// balancer legitimately see other addresses. Wildcard entries are
+	// skipped.
+	VerifyDNS bool
+	// OCSPUpdateInterval, if set, fetches an OCSP response for Certificate
+	// from the responder named in it at this interval and staples it to
+	// handshakes. A failed fetch keeps the previous staple and is retried
+	// within minutes.
+	OCSPUpdateInterval time.Duration
+	// ApproveIssuance, if set, is consulted before a certificate is ordered
+	// for a domain, both on a handshake for an uncached domain and on
+	// renewal. A non-nil error blocks the order and fails the handshake;
+	// handshakes served from a valid cached certificate never reach it.
+	// autocert's own last-resort renewal, within about an hour of expiry,
+	// is not gated.
+	ApproveIssuance func(domain string) error
+	// ExtKeyUsage lists the extended key usages requested in the CSR. It
+	// must include x509.ExtKeyUsageServerAuth; usages unsuitable for a TLS
+	// server are refused. Unset leaves the choice to the CA. Most CAs ignore
+	// the request or only honour server and client authentication.
+	ExtKeyUsage []x509.ExtKeyUsage
+	// RestoreState is state saved by ExportState before a restart, restoring
+	// renewal times, domain sets and Stats counters. It must come from a
+	// listener for the same Domain.
+	RestoreState []byte
+	// MetricsLabels tag everything this listener reports, so several
+	// listeners in one process can be told apart: they are returned by
+	// MetricsLabels, included in Status and added to JSONLogs lines
+	MetricsLabels map[string]string
+	// DisableSessionTickets turns off session resumption for TLS 1.2
+	// handshakes, forcing a full handshake with fresh ephemeral keys each
+	// time, since TLS 1.2 tickets are encrypted with a long-lived key and
+	// undermine forward secrecy. TLS 1.3 keeps its tickets, whose
+	// resumption still performs a key exchange. This is why it is applied
+	// per handshake rather than as tls.Config.SessionTicketsDisabled, which
+	// would turn off TLS 1.3 tickets as well.
+	DisableSessionTickets bool
+	// CacheKeyFunc maps each cache key autocert uses, for certificates and
+	// the ACME account key alike, to the key stored in CertDir or Cache, e.g.
+	// to namespace a cache shared by several services. It must be
+	// deterministic and give distinct results for distinct keys. KeepOldCerts
+	// pruning only recognises archived entries whose stored name keeps the
+	// "+old-<unix time>" suffix.
+	CacheKeyFunc func(key string) string
+	// VerifyALPNChallenge checks at startup that TLS-ALPN-01 validation
+	// handshakes are offered the acme-tls/1 protocol, logging a warning if
+	// the TLS configuration has lost it. It is skipped with a static
+	// Certificate or a read-only cache, which never validate.
+	VerifyALPNChallenge bool
+	// OnServingExpired is called when a handshake is served with an expired
+	// certificate, at most once a minute per domain, with how long ago it
+	// expired. Only a static Certificate, InternalCertificate or
+	// FallbackGetCertificate can cause this; autocert refuses expired
+	// certificates.
+	OnServingExpired func(domain string, expiredSince time.Duration)
+	// MaxConcurrentHandshakes bounds how many handshakes may look up their
+	// certificate at once, so a burst of first connections to new domains
+	// cannot stampede the CA. A handshake waits up to two seconds for a slot
+	// and then fails. ACME validation handshakes are never held back, as
+	// issuance depends on them. Zero means no limit.
+	MaxConcurrentHandshakes int
+	// AtomicCache makes CertDir writes durable: each entry is written to a
+	// temporary file, synced to disk and renamed into place, and the
+	// directory is synced, so a crash cannot leave a torn certificate. It
+	// does not apply to a custom Cache.
+	AtomicCache bool
 
+	// OnRenewalCheck is called at the end of each pass of the renewal checks,
+	// including the startup check and paused passes, with whether any
+	// certificate was due for renewal and the first error met, if any. It
+	// lets tests and monitoring wait for a pass instead of sleeping.
+	OnRenewalCheck func(shouldRenew bool, err error)
+
+	// DomainKeyType overrides, per domain, the key type of the certificates
+	// issued and served. Domains not listed, and those set to KeyTypeAuto,
+	// get ECDSA for clients that support it and RSA for the rest. Entries
+	// may be "*.example.com" wildcards.
+	DomainKeyType map[string]KeyType
 	//DNSProvider autocert.DNS01Provider
 }
 
@@ -48,86 +521,740 @@ func New(cfg Config) (*TLSListener, error) {
 	if cfg.Domain == "" {
 		return nil, errors.New("domain is required")
 	}
-	if cfg.CertDir == "" {
+	if strings.HasPrefix(cfg.Domain, "*.") {
+		return nil, errors.New("domain must not be a wildcard; list wildcards in AllowedDomains")
+	}
+	if cfg.CertDir == "" && cfg.Cache == nil {
 		return nil, errors.New("certificate directory is required")
 	}
+	if (cfg.InitialCertPEM == nil) != (cfg.InitialKeyPEM == nil) {
+		return nil, errors.New("InitialCertPEM and InitialKeyPEM must be set together")
+	}
+	if err := validateListenAddr("HTTPChallengeAddr", cfg.HTTPChallengeAddr); err != nil {
+		return nil, err
+	}
+	domainKeyTypes, err := normalizeKeyTypes(cfg.DomainKeyType)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.HTTPChallengeListener != nil && cfg.HTTPChallengeAddr != "" {
+		return nil, errors.New("HTTPChallengeAddr and HTTPChallengeListener are mutually exclusive")
+	}
+	switch cfg.Network {
+	case "", "tcp", "tcp4", "tcp6":
+		if err := validateListenAddr("ListenAddr", cfg.ListenAddr); err != nil {
+			return nil, err
+		}
+	case "unix":
+		if cfg.BaseListener == nil && cfg.Certificate == nil {
+			return nil, errors.New("a unix socket cannot answer ACME challenges; Certificate is required")
+		}
+	default:
+		return nil, errors.Errorf("unsupported network %q", cfg.Network)
+	}
+	if cfg.InitialCertPEM != nil && cfg.ReadOnlyCache {
+		return nil, errors.New("InitialCertPEM cannot seed a read-only cache")
+	}
+	if cfg.KeepOldCerts > 0 && cfg.Cache != nil {
+		// Archives would go to the Cache, where pruning cannot list them
+		return nil, errors.New("KeepOldCerts requires CertDir; it cannot prune a custom Cache")
+	}
 
 	tl := &TLSListener{
-		domain:         cfg.Domain,
-		certDir:        cfg.CertDir,
-		email:          cfg.Email,
-		allowedDomains: append([]string{cfg.Domain}, cfg.AllowedDomains...),
+		domain:               cfg.Domain,
+		certDir:              cfg.CertDir,
+		email:                cfg.Email,
+		readOnly:             cfg.ReadOnlyCache,
+		idleTimeout:          cfg.IdleTimeout,
+		renewAfter:           cfg.RenewAfter,
+		renewMargin:          cfg.RenewSafetyMargin,
+		renewBefore:          cfg.RenewBefore,
+		onFirstIssue:         cfg.OnFirstIssue,
+		issueTimeout:         cfg.IssuanceTimeout,
+		fallbackGetCert:      cfg.FallbackGetCertificate,
+		domainMargins:        make(map[string]time.Duration, len(cfg.DomainRenewBefore)),
+		clientCAs:            cfg.ClientCAs,
+		clientAuth:           cfg.ClientAuth,
+		internalDomains:      make(map[string]bool, len(cfg.InternalDomains)),
+		useARI:               cfg.UseARI,
+		nowFunc:              time.Now,
+		conns:                make(map[*conn]struct{}),
+		onClientHello:        cfg.OnClientHello,
+		keepOldCerts:         cfg.KeepOldCerts,
+		mustStaple:           cfg.MustStaple,
+		tcpKeepAlive:         cfg.TCPKeepAlive,
+		handshakeCertTimeout: cfg.HandshakeCertTimeout,
+		disableHTTP2:         cfg.DisableHTTP2,
+		onRenewError:         cfg.OnRenewError,
+		lastRenewal:          make(map[string]time.Time),
+		controlFunc:          cfg.ControlFunc,
+		directoryURL:         cfg.DirectoryURL,
+		acmeTLSConfig:        cfg.ACMETLSConfig,
+		cache:                cfg.Cache,
+		done:                 make(chan struct{}),
+		renewalLeaseTTL:      cfg.RenewalLeaseTTL,
+		leaseOwner:           newLeaseOwner(),
+		disabledDomains:      make(map[string]bool),
+		logger:               cfg.Logger,
+		logRejectedHosts:     cfg.LogRejectedHosts,
+		onPanic:              cfg.OnPanic,
+		onCertificateServed:  cfg.OnCertificateServed,
+		minValidity:          cfg.MinRemainingValidity,
+		jsonLogs:             cfg.JSONLogs,
+		shouldRenewFunc:      cfg.ShouldRenewFunc,
+		network:              cfg.Network,
+		listenAddr:           cfg.ListenAddr,
+		staticCert:           withLeaf(cfg.Certificate),
+		sniErrorHandler:      cfg.SNIErrorHandler,
+		httpChallengeAddr:    cfg.HTTPChallengeAddr,
+		challengeListener:    cfg.HTTPChallengeListener,
+		userWrapConn:         cfg.WrapConn,
+		fallbackDirectoryURL: cfg.FallbackDirectoryURL,
+		fallbackEAB:          cfg.FallbackExternalAccountBinding,
+		issuingCA:            make(map[string]string),
+		proxyProtocol:        cfg.ProxyProtocol,
+		maxDomains:           cfg.MaxDomains,
+		orderedDomains:       make(map[string]bool),
+		compressCache:        cfg.CompressCache,
+		onHandshakeComplete:  cfg.OnHandshakeComplete,
+		debugRenewal:         cfg.DebugRenewal,
+		skipStartupCheck:     cfg.DisableStartupRenewalCheck,
+		validateCert:         cfg.ValidateCertificate,
+		blockInvalid:         cfg.BlockInvalidCertificates,
+		rejectedSerials:      make(map[string]bool),
+		userAgent:            cfg.UserAgent,
+		userConfigForClient:  cfg.GetConfigForClient,
+		domainsFile:          cfg.DomainsFile,
+		configDomains:        append([]string{cfg.Domain}, cfg.AllowedDomains...),
+		includeWWW:           cfg.IncludeWWW,
+		ocspInterval:         cfg.OCSPUpdateInterval,
+		approveIssuance:      cfg.ApproveIssuance,
+		acmeOrders:           make(map[string]acmeOrder),
+		ownsBase:             !cfg.KeepBaseListenerOpen,
+		disableTickets:       cfg.DisableSessionTickets,
+		cacheKeyFunc:         cfg.CacheKeyFunc,
+		onServingExpired:     cfg.OnServingExpired,
+		expiredNotified:      make(map[string]time.Time),
+		atomicCache:          cfg.AtomicCache,
+		onRenewalCheck:       cfg.OnRenewalCheck,
+		domainKeyTypes:       domainKeyTypes,
+		ready:                make(chan struct{}),
+	}
+	tl.servedStatic.Store(tl.staticCert)
+
+	if cfg.Allow0RTT {
+		tl.logf("Allow0RTT is set, but crypto/tls does not support server-side early data; 0-RTT stays disabled")
+	}
+
+	var fileDomains []string
+	if cfg.DomainsFile != "" {
+		var err error
+		if fileDomains, err = tl.readDomainsFile(); err != nil {
+			return nil, err
+		}
+	}
+	tl.setFileDomains(fileDomains)
+
+	if cfg.VerifyDNS && !tl.readOnly && tl.staticCert == nil {
+		if err := tl.verifyDNS(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(cfg.ExtKeyUsage) > 0 {
+		ext, err := extKeyUsageExtension(cfg.ExtKeyUsage)
+		if err != nil {
+			return nil, err
+		}
+		tl.extraExtensions = append(tl.extraExtensions, ext)
+	}
+
+	if cfg.MaxConcurrentHandshakes > 0 {
+		tl.handshakeSlots = make(chan struct{}, cfg.MaxConcurrentHandshakes)
+	}
+
+	if len(cfg.MetricsLabels) > 0 {
+		tl.metricsLabels = make(map[string]string, len(cfg.MetricsLabels))
+		for k, v := range cfg.MetricsLabels {
+			tl.metricsLabels[k] = v
+		}
+	}
+
+	if cfg.RestoreState != nil {
+		if err := tl.restoreState(cfg.RestoreState); err != nil {
+			return nil, err
+		}
+	}
+
+	for domain, margin := range cfg.DomainRenewBefore {
+		tl.domainMargins[normalizeDomain(domain)] = margin
+	}
+
+	for _, cidr := range cfg.AllowedClientCIDRs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid client CIDR %q", cidr)
+		}
+		tl.allowedCIDRs = append(tl.allowedCIDRs, ipNet)
+	}
+
+	for _, domain := range cfg.InternalDomains {
+		tl.internalDomains[normalizeDomain(domain)] = true
+	}
+	tl.internalCert.Store(withLeaf(cfg.InternalCertificate))
+	if len(cfg.InternalDomains) > 0 && cfg.InternalCertificate == nil {
+		cert, err := selfSignedCert(cfg.InternalDomains, selfSignedValidity)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to generate internal certificate")
+		}
+		tl.internalCert.Store(cert)
+		tl.internalHosts = cfg.InternalDomains
+	}
+
+	if tl.proxyProtocol && tl.sniErrorHandler == nil {
+		// Screening already completes handshakes, and so reads the header,
+		// before handing connections out
+		tl.proxied = newProxyQueue(tl.acceptTLS, tl.done)
+	}
+
+	if tl.sniErrorHandler != nil {
+		if err := tl.startSNIErrorServer(); err != nil {
+			return nil, err
+		}
 	}
 
 	if err := tl.setup(cfg.BaseListener); err != nil {
+		tl.abort()
 		return nil, errors.Wrap(err, "failed to setup TLS listener")
 	}
 
-	// Start certificate renewal goroutine
-	go tl.renewalRoutine()
+	if cfg.VerifyALPNChallenge && tl.renewsACME() {
+		tl.verifyALPNChallenge()
+	}
+
+	if cfg.InitialCertPEM != nil {
+		if err := tl.seedCache(cfg.InitialCertPEM, cfg.InitialKeyPEM); err != nil {
+			tl.abort()
+			return nil, errors.Wrap(err, "failed to seed certificate cache")
+		}
+	}
+
+	if tl.minValidity > 0 {
+		if err := tl.ensureValidity(); err != nil {
+			tl.abort()
+			return nil, err
+		}
+	}
+
+	tl.checkReady()
+
+	if tl.domainsFile != "" {
+		go tl.watchDomainsFile()
+	}
+
+	if tl.staticCert != nil && tl.ocspInterval > 0 {
+		go tl.ocspRoutine()
+	}
+
+	// Start certificate renewal goroutine; read-only replicas and static
+	// certificates never renew, but generated self-signed ones still do
+	if tl.renewsACME() || tl.generatesSelfSigned() {
+		go tl.renewalRoutine()
+	}
 
 	return tl, nil
 }
 
-func (tl *TLSListener) setup(baseListener net.Listener) error {
-	// Create the autocert manager
+// lastResortRenewBefore is the RenewBefore given to autocert: just above its
+// one hour of renewal jitter, below which it would renew 30 days ahead
+const lastResortRenewBefore = time.Hour + 5*time.Minute
+
+// mustStapleExtension is the TLS Feature extension (RFC 7633) requesting
+// status_request, i.e. DER SEQUENCE { INTEGER 5 }
+var mustStapleExtension = pkix.Extension{
+	Id:    asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24},
+	Value: []byte{0x30, 0x03, 0x02, 0x01, 0x05},
+}
+
+// newManager creates an autocert manager backed by the given cert
+// directory, ordering from the primary CA
+func (tl *TLSListener) newManager(certDir string) *autocert.Manager {
+	return tl.newManagerForCA(certDir, tl.directoryURL, nil)
+}
+
+// newManagerForCA creates an autocert manager backed by the given cert
+// directory that orders from the CA at directoryURL, using eab if the CA
+// requires external account binding
+func (tl *TLSListener) newManagerForCA(certDir, directoryURL string, eab *acme.ExternalAccountBinding) *autocert.Manager {
+	var cache autocert.Cache = autocert.DirCache(certDir)
+	if tl.atomicCache {
+		cache = syncedDirCache{autocert.DirCache(certDir)}
+	}
+	if tl.cache != nil {
+		cache = tl.cache
+	}
+	if tl.cacheKeyFunc != nil {
+		cache = keyedCache{cache, tl.cacheKeyFunc}
+	}
+	if tl.compressCache {
+		cache = gzipCache{cache}
+	}
+
 	certManager := &autocert.Manager{
-		Cache:      autocert.DirCache(tl.certDir),
+		Cache:      &reportingCache{Cache: cache, tl: tl},
 		Prompt:     autocert.AcceptTOS,
 		Email:      tl.email,
-		HostPolicy: autocert.HostWhitelist(tl.allowedDomains...),
+		HostPolicy: tl.hostPolicy(),
+	}
+
+	certManager.ExternalAccountBinding = eab
+
+	if directoryURL == "" {
+		directoryURL = autocert.DefaultACMEDirectory
+	}
+	transport := http.DefaultTransport
+	if tl.acmeTLSConfig != nil {
+		transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tl.acmeTLSConfig,
+		}
+	}
+	certManager.Client = &acme.Client{
+		DirectoryURL: directoryURL,
+		HTTPClient: &http.Client{
+			Transport: &orderRecorder{base: transport, tl: tl, directoryURL: directoryURL},
+		},
+	}
+	if tl.userAgent != "" {
+		// Keep autocert's own token after ours, as it would add it to an
+		// unset UserAgent
+		certManager.Client.UserAgent = tl.userAgent + " autocert"
 	}
 
-	// Create TLS config
+	if tl.readOnly {
+		// autocert only consults HostPolicy before ordering a new certificate,
+		// so rejecting every host turns a cache miss into a handshake error.
+		// The cache and ACME client are also locked down so that autocert's
+		// own renewal timers can never write to the shared cache or place an
+		// order; they will pick up certificates renewed by the leader instead.
+		certManager.Cache = readOnlyCache{cache}
+		certManager.HostPolicy = func(_ context.Context, host string) error {
+			return errors.Errorf("no cached certificate for %q and cache is read-only", host)
+		}
+		certManager.Client = &acme.Client{
+			DirectoryURL: directoryURL,
+			HTTPClient:   &http.Client{Transport: readOnlyTransport{}},
+		}
+	}
+
+	// autocert renews on its own timers too, ordering behind the back of
+	// ApproveIssuance and RenewalLeaseTTL, so they are left as a last resort
+	// the renewal routine always beats
+	certManager.RenewBefore = lastResortRenewBefore
+
+	if tl.mustStaple {
+		certManager.ExtraExtensions = append(certManager.ExtraExtensions, mustStapleExtension)
+	}
+	certManager.ExtraExtensions = append(certManager.ExtraExtensions, tl.extraExtensions...)
+
+	if tl.http01.Load() {
+		// HTTPHandler is what switches autocert over to trying http-01
+		certManager.HTTPHandler(nil)
+	}
+
+	return certManager
+}
+
+func (tl *TLSListener) setup(baseListener net.Listener) error {
+	// Create the autocert manager
+	certManager := tl.newManager(tl.certDir)
+
+	// Create TLS config. GetCertificate goes through the listener rather than
+	// straight to the manager so the manager can be swapped at runtime.
 	tlsConfig := certManager.TLSConfig()
+	tlsConfig.GetCertificate = tl.handshakeCertificate
 	tlsConfig.MinVersion = tls.VersionTLS12
+	tlsConfig.ClientCAs = tl.clientCAs
+	tlsConfig.ClientAuth = tl.clientAuth
+	tlsConfig.GetConfigForClient = tl.getConfigForClient
+	if tl.disableHTTP2 {
+		tlsConfig.NextProtos = []string{"http/1.1", acme.ALPNProto}
+	}
 
 	var listener net.Listener
 	var err error
 
 	if baseListener == nil {
-		// Create a new TCP listener if none provided
-		listener, err = tls.Listen("tcp", ":443", tlsConfig)
+		// Create a new listener if none provided
+		listener, err = tl.listen(tl.socket())
 		if err != nil {
 			return errors.Wrap(err, "failed to create TLS listener")
 		}
 	} else {
-		// Wrap existing listener with TLS
-		listener = tls.NewListener(baseListener, tlsConfig)
+		if err := tl.validateBaseListener(baseListener); err != nil {
+			return err
+		}
+		listener = baseListener
 	}
 
+	// TLS is layered on in Accept, on top of our own connection wrapper, so
+	// that callers still receive a *tls.Conn (net/http relies on this for
+	// HTTP/2 and Request.TLS)
 	tl.mu.Lock()
 	tl.listener = listener
-	tl.certManager = certManager
+	tl.ownsListener = baseListener == nil
+	tl.tlsConfig = tlsConfig
+	tl.configSnap.Store(tlsConfig)
+	tl.setManager(certManager)
 	tl.mu.Unlock()
 
 	return nil
 }
 
+// socketSpec describes a socket wileedot creates itself, from Network,
+// ListenAddr and ControlFunc
+type socketSpec struct {
+	network string
+	addr    string
+	control func(network, address string, c syscall.RawConn) error
+}
+
+// socket returns the spec of the listener's own socket
+func (tl *TLSListener) socket() socketSpec {
+	tl.mu.RLock()
+	defer tl.mu.RUnlock()
+	return socketSpec{network: tl.network, addr: tl.listenAddr, control: tl.controlFunc}
+}
+
+// listen creates the listener described by spec, on ":443" if it names no
+// address
+func (tl *TLSListener) listen(spec socketSpec) (net.Listener, error) {
+	if spec.addr == "" {
+		spec.addr = ":443"
+	}
+	return tl.listenOn(spec)
+}
+
+// listenOn creates the listener described by spec
+func (tl *TLSListener) listenOn(spec socketSpec) (net.Listener, error) {
+	network, addr := spec.network, spec.addr
+	if network == "" {
+		network = "tcp"
+	}
+
+	if network == "unix" {
+		features := tl.tcpFeatures()
+		if len(tl.allowedCIDRs) > 0 {
+			features = append(features, "AllowedClientCIDRs")
+		}
+		if len(features) > 0 {
+			return nil, errors.Errorf("%s cannot be used on a unix socket", strings.Join(features, ", "))
+		}
+		if err := removeStaleSocket(addr); err != nil {
+			return nil, err
+		}
+	}
+
+	// A unix listener created here removes its socket file on Close
+	lc := net.ListenConfig{Control: spec.control}
+	return lc.Listen(context.Background(), network, addr)
+}
+
+// removeStaleSocket deletes a socket file left behind at path by a previous
+// process, refusing to touch one that something is still listening on
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to inspect %s", path)
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return errors.Errorf("%s exists and is not a socket", path)
+	}
+
+	if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		c.Close()
+		return errors.Errorf("socket %s is in use", path)
+	}
+	return os.Remove(path)
+}
+
+// tcpFeatures lists the enabled features that only work over TCP
+func (tl *TLSListener) tcpFeatures() []string {
+	var features []string
+	if tl.tcpKeepAlive > 0 {
+		features = append(features, "TCPKeepAlive")
+	}
+	return features
+}
+
+// validateBaseListener checks that a user-supplied listener supports every
+// enabled feature, so misconfiguration fails in New rather than per connection
+func (tl *TLSListener) validateBaseListener(baseListener net.Listener) error {
+	tcpFeatures := tl.tcpFeatures()
+	if len(tcpFeatures) == 0 {
+		return nil
+	}
+
+	if _, ok := baseListener.Addr().(*net.TCPAddr); !ok {
+		return errors.Errorf("%s requires a TCP listener, but BaseListener listens on %s %q",
+			strings.Join(tcpFeatures, ", "), baseListener.Addr().Network(), baseListener.Addr())
+	}
+	return nil
+}
+
 // Implementation of net.Listener interface
 
+// Accept is safe to call from multiple goroutines at once; the underlying
+// listener hands each connection to exactly one caller. The lock is only held
+// while reading the listener fields, never across the blocking Accept, so
+// Close can always proceed and unblock every waiting caller.
 func (tl *TLSListener) Accept() (net.Conn, error) {
-	tl.mu.RLock()
-	listener := tl.listener
-	tl.mu.RUnlock()
+	if tl.sniErrorHandler != nil {
+		return tl.acceptScreened()
+	}
 
-	if listener == nil {
-		return nil, errors.New("listener is closed")
+	var tc *tls.Conn
+	var err error
+	if tl.proxied != nil {
+		tc, err = tl.proxied.next()
+	} else {
+		tc, err = tl.acceptTLS()
+	}
+	if err != nil {
+		return nil, err
+	}
+	tl.observeLazily(tc)
+	return tc, nil
+}
+
+// acceptTLS accepts the next allowed connection and layers TLS on top,
+// without starting the handshake
+func (tl *TLSListener) acceptTLS() (*tls.Conn, error) {
+	for {
+		tl.mu.RLock()
+		listener := tl.listener
+		draining := tl.draining
+		tl.mu.RUnlock()
+
+		if listener == nil || draining {
+			return nil, ErrListenerClosed
+		}
+		tc, err := tl.acceptFrom(listener, tl.isClosed)
+		if err == ErrListenerClosed && tl.rebound(listener) {
+			// Rebind closed the socket this call was waiting on
+			continue
+		}
+		return tc, err
+	}
+}
+
+// acceptFrom accepts the next allowed connection from listener and layers
+// TLS on top. closed reports whether listener has been closed on purpose.
+func (tl *TLSListener) acceptFrom(listener net.Listener, closed func() bool) (*tls.Conn, error) {
+	var c net.Conn
+	for {
+		var err error
+		c, err = listener.Accept()
+		if err != nil {
+			// A BaseListener closed behind our back would otherwise fail
+			// every Accept, spinning callers that retry on error
+			if closed() || errors.Is(err, net.ErrClosed) {
+				return nil, ErrListenerClosed
+			}
+			tl.stats.acceptErrors.Add(1)
+			return nil, err
+		}
+		// A BaseListener left open by Close still accepts; its connections
+		// are no longer ours to hand out
+		if closed() {
+			c.Close()
+			return nil, ErrListenerClosed
+		}
+		if tl.clientAllowed(c.RemoteAddr()) {
+			break
+		}
+		// Disallowed clients are dropped before the handshake and never
+		// reach the caller
+		c.Close()
+	}
+	tl.stats.accepted.Add(1)
+
+	return tls.Server(tl.wrapConn(c), tl.configSnap.Load()), nil
+}
+
+// AcceptContext is like Accept but returns ctx.Err() as soon as ctx is
+// done. The underlying Accept cannot be interrupted, so it keeps waiting in
+// the background; a connection it accepts after cancellation is closed on
+// the spot rather than handed to anyone, and is lost to other callers.
+func (tl *TLSListener) AcceptContext(ctx context.Context) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, err := tl.Accept()
+		done <- result{c, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// clientAllowed reports whether addr falls inside AllowedClientCIDRs
+func (tl *TLSListener) clientAllowed(addr net.Addr) bool {
+	if len(tl.allowedCIDRs) == 0 {
+		return true
+	}
+
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return false
+		}
+		ip = net.ParseIP(host)
+	}
+	if ip == nil {
+		return false
+	}
+
+	for _, ipNet := range tl.allowedCIDRs {
+		if ipNet.Contains(ip) {
+			return true
+		}
 	}
-	return listener.Accept()
+	return false
 }
 
+// Close stops accepting connections, unblocking pending Accept calls with
+// ErrListenerClosed. Like any net.Listener it leaves accepted connections
+// alone, unless Drain was called first, in which case Close completes the
+// teardown by closing the connections still open. A BaseListener is closed
+// too, unless KeepBaseListenerOpen is set; one the caller already closed is
+// not reported as an error.
 func (tl *TLSListener) Close() error {
+	tl.stopRenewal()
+	tl.closeSNIErrorServer()
+
 	tl.mu.Lock()
-	defer tl.mu.Unlock()
+	challengeServers := tl.challengeServers
+	tl.challengeServers = nil
+	additional := tl.additionalListeners
+	tl.additionalListeners = nil
 
-	if tl.listener == nil {
+	var listener net.Listener
+	if tl.draining {
+		tl.closeConns()
+	} else if tl.ownsListener || tl.ownsBase {
+		listener = tl.listener
+	}
+	tl.listener = nil
+	tl.draining = false
+	tl.mu.Unlock()
+
+	// Everything is closed outside the lock, so that a base listener or
+	// challenge server whose Close blocks cannot hold up every other method
+	closeChallengeServers(challengeServers)
+	closeAdditionalListeners(additional)
+	if listener == nil {
 		return nil
 	}
+	if err := listener.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// CloseTimeout is like Close, but stops waiting after d and returns an
+// error, guarding shutdown against a base listener, challenge listener or
+// additional listener whose Close blocks. The
+// renewal routine is stopped either way; after a timeout the close carries
+// on in the background.
+func (tl *TLSListener) CloseTimeout(d time.Duration) error {
+	tl.stopRenewal()
+
+	done := make(chan error, 1)
+	go func() { done <- tl.Close() }()
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return errors.Errorf("timed out closing listener after %v", d)
+	}
+}
+
+// abort releases everything a failed New had acquired. Unlike Close it
+// leaves a caller-supplied BaseListener open, since the caller still owns it.
+func (tl *TLSListener) abort() {
+	tl.stopRenewal()
+	tl.closeSNIErrorServer()
 
-	err := tl.listener.Close()
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	if tl.listener != nil && tl.ownsListener {
+		tl.listener.Close()
+	}
 	tl.listener = nil
-	return err
+}
+
+// stopRenewal stops the renewal routine; it is safe to call more than once
+func (tl *TLSListener) stopRenewal() {
+	tl.stopOnce.Do(func() {
+		close(tl.done)
+	})
+}
+
+// Drain stops accepting new connections, so load balancers route elsewhere,
+// while connections already accepted stay open until they close themselves.
+// Accept returns ErrListenerClosed from then on; call Close to finish. Like
+// Close, it leaves BaseListener open under KeepBaseListenerOpen.
+func (tl *TLSListener) Drain() error {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	if tl.listener == nil || tl.draining {
+		return nil
+	}
+
+	tl.draining = true
+	if !tl.ownsListener && !tl.ownsBase {
+		return nil
+	}
+	if err := tl.listener.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// isClosed reports whether Close or Drain has been called
+func (tl *TLSListener) isClosed() bool {
+	tl.mu.RLock()
+	defer tl.mu.RUnlock()
+	return tl.listener == nil || tl.draining
 }
 
 func (tl *TLSListener) Addr() net.Addr {
@@ -140,90 +1267,425 @@ func (tl *TLSListener) Addr() net.Addr {
 	return tl.listener.Addr()
 }
 
-// certInfo holds certificate timing information
-type certInfo struct {
+// CertInfo holds certificate timing information, as passed to
+// Config.ShouldRenewFunc
+type CertInfo struct {
+	Domain    string
 	NotBefore time.Time
 	NotAfter  time.Time
 }
 
-// getCertInfo extracts timing information from the current certificate
-func (tl *TLSListener) getCertInfo() (*certInfo, error) {
+// getCertInfo extracts timing information from the current certificate for domain
+func (tl *TLSListener) getCertInfo(domain string) (*CertInfo, error) {
+	leaf, err := tl.LeafCertificate(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CertInfo{
+		Domain:    normalizeDomain(domain),
+		NotBefore: leaf.NotBefore,
+		NotAfter:  leaf.NotAfter,
+	}, nil
+}
+
+// LeafCertificate returns the parsed leaf certificate currently served for domain
+func (tl *TLSListener) LeafCertificate(domain string) (*x509.Certificate, error) {
 	tl.mu.RLock()
 	manager := tl.certManager
 	tl.mu.RUnlock()
 
+	return tl.leafCertificate(manager, domain)
+}
+
+// leafCertificate fetches and parses the leaf certificate manager serves for domain
+func (tl *TLSListener) leafCertificate(manager *autocert.Manager, domain string) (*x509.Certificate, error) {
+	if tl.staticCert != nil {
+		return staticLeaf(tl.staticCert)
+	}
+
+	cert, err := tl.servedCertificate(manager, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	// Extract leaf certificate
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse certificate")
+	}
+
+	return leaf, nil
+}
+
+// servedCertificate fetches the certificate manager serves for domain
+func (tl *TLSListener) servedCertificate(manager *autocert.Manager, domain string) (*tls.Certificate, error) {
+	if tl.staticCert != nil {
+		return tl.staticCertificate(), nil
+	}
 	if manager == nil {
 		return nil, errors.New("cert manager is not initialized")
 	}
 
 	// Get current certificate
-	cert, err := manager.GetCertificate(&tls.ClientHelloInfo{
-		ServerName: tl.domain,
-	})
+	cert, err := tl.managerCertificate(manager, helloFor(domain))
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to get current certificate")
 	}
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("current certificate is empty")
+	}
+	return cert, nil
+}
 
-	// Extract leaf certificate
-	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+// CertificateChain returns the full chain served for domain, leaf first,
+// in the order it is sent to clients
+func (tl *TLSListener) CertificateChain(domain string) ([]*x509.Certificate, error) {
+	tl.mu.RLock()
+	manager := tl.certManager
+	tl.mu.RUnlock()
+
+	cert, err := tl.servedCertificate(manager, domain)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to parse certificate")
+		return nil, err
 	}
 
-	return &certInfo{
-		NotBefore: leaf.NotBefore,
-		NotAfter:  leaf.NotAfter,
-	}, nil
+	chain := make([]*x509.Certificate, 0, len(cert.Certificate))
+	for i, der := range cert.Certificate {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse certificate %d of chain", i)
+		}
+		chain = append(chain, c)
+	}
+	return chain, nil
+}
+
+// helloFor builds a synthetic ClientHello for domain. It advertises ECDSA
+// support so autocert looks up the same certificate modern clients are
+// served, rather than the RSA fallback it picks for an empty hello.
+func helloFor(domain string) *tls.ClientHelloInfo {
+	return &tls.ClientHelloInfo{
+		ServerName:   domain,
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	}
 }
 
-// shouldRenew checks if the certificate should be renewed
-func (tl *TLSListener) shouldRenew() (bool, error) {
-	info, err := tl.getCertInfo()
+// shouldRenew checks if the certificate for domain should be renewed
+func (tl *TLSListener) shouldRenew(domain string) (bool, error) {
+	if tl.shouldRenewFunc != nil {
+		info, err := tl.getCertInfo(domain)
+		if err != nil {
+			return false, err
+		}
+		renew := tl.shouldRenewFunc(*info)
+		if tl.debugRenewal {
+			tl.logf("Renewal check for %s (ShouldRenewFunc): notBefore=%v notAfter=%v now=%v renew=%t",
+				domain, info.NotBefore, info.NotAfter, tl.now(), renew)
+		}
+		return renew, nil
+	}
+
+	if tl.useARI {
+		renew, err := tl.ariShouldRenew(domain)
+		if err == nil {
+			return renew, nil
+		}
+		tl.logf("ARI unavailable for %s, using renewal heuristic: %v", domain, err)
+	}
+
+	info, err := tl.getCertInfo(domain)
 	if err != nil {
 		return false, err
 	}
 
-	now := time.Now()
+	now := tl.now()
+	renewAt := tl.renewalTime(domain, info)
+	renew := !now.Before(renewAt)
+	if tl.debugRenewal {
+		tl.logf("Renewal check for %s: notBefore=%v notAfter=%v now=%v renewAfter=%v renewBefore=%v safetyMargin=%v renewAt=%v renew=%t",
+			domain, info.NotBefore, info.NotAfter, now, tl.renewAfter, tl.renewBefore, tl.safetyMargin(domain), renewAt, renew)
+	}
+	return renew, nil
+}
 
-	// Check if it's been at least 2 months since the last renewal
-	twoMonthsAgo := now.AddDate(0, -2, 0)
-	if info.NotBefore.After(twoMonthsAgo) {
-		return false, nil
+// renewalTime returns when the renewal heuristic falls due for a
+// certificate for domain with the given validity
+func (tl *TLSListener) renewalTime(domain string, info *CertInfo) time.Time {
+	if tl.renewBefore > 0 {
+		return info.NotAfter.Add(-tl.safetyMargin(domain))
+	}
+
+	// Renew once the certificate has reached the configured age
+	// (two months unless RenewAfter says otherwise)
+	renewAt := info.NotBefore.AddDate(0, 2, 0)
+	if tl.renewAfter > 0 {
+		renewAt = info.NotBefore.Add(tl.renewAfter)
+	}
+
+	// As a safety check, also renew once we're within the safety margin
+	// (30 days by default) of expiration, however young the certificate is
+	if marginAt := info.NotAfter.Add(-tl.safetyMargin(domain)); marginAt.Before(renewAt) {
+		renewAt = marginAt
+	}
+	return renewAt
+}
+
+// NextRenewalEstimate returns the soonest time the renewal heuristic will
+// want to renew the primary domain's certificate, per RenewAfter, RenewBefore,
+// RenewSafetyMargin and DomainRenewBefore. It makes no network calls, so
+// an ARI-suggested window (UseARI) is not taken into account. The renewal
+// routine checks daily and may act up to a day later than this.
+func (tl *TLSListener) NextRenewalEstimate() (time.Time, error) {
+	if tl.shouldRenewFunc != nil {
+		return time.Time{}, errors.New("renewal is decided by ShouldRenewFunc and cannot be estimated")
 	}
 
-	// As a safety check, also renew if we're within 30 days of expiration
-	thirtyDaysFromNow := now.AddDate(0, 0, 30)
-	if thirtyDaysFromNow.After(info.NotAfter) {
-		return true, nil
+	info, err := tl.getCertInfo(tl.domain)
+	if err != nil {
+		return time.Time{}, err
 	}
+	return tl.renewalTime(tl.domain, info), nil
+}
 
-	return true, nil
+// now returns the current time according to the listener's clock
+func (tl *TLSListener) now() time.Time {
+	if tl.nowFunc == nil {
+		return time.Now()
+	}
+	return tl.nowFunc()
 }
 
-// renewalRoutine handles periodic certificate renewal checks
+// safetyMargin returns how long before expiry domain's certificate must be
+// renewed: its DomainRenewBefore entry, else RenewBefore, else
+// RenewSafetyMargin, else 30 days
+func (tl *TLSListener) safetyMargin(domain string) time.Duration {
+	if margin, ok := tl.domainMargins[normalizeDomain(domain)]; ok && margin > 0 {
+		return margin
+	}
+	if tl.renewBefore > 0 {
+		return tl.renewBefore
+	}
+	if tl.renewMargin > 0 {
+		return tl.renewMargin
+	}
+	return 30 * 24 * time.Hour
+}
+
+// renewalRoutine handles periodic certificate renewal checks. The first
+// check runs straight away, so a certificate that fell due while the
+// process was down is not left for another day. Each daily tick also
+// regenerates expiring self-signed certificates.
 func (tl *TLSListener) renewalRoutine() {
 	ticker := time.NewTicker(24 * time.Hour) // Check daily
 	defer ticker.Stop()
 
-	for range ticker.C {
-		shouldRenew, err := tl.shouldRenew()
-		if err != nil {
-			logf("Failed to check certificate renewal status: %v", err)
+	renewsACME := tl.renewsACME()
+	if renewsACME && !tl.skipStartupCheck {
+		// Domains without a cached certificate get one on first handshake;
+		// the startup check should not order them all at once
+		tl.checkAllRenewals(true)
+	}
+
+	for {
+		select {
+		case <-tl.done:
+			return
+		case <-ticker.C:
+		}
+
+		tl.refreshSelfSigned()
+		if renewsACME {
+			tl.checkAllRenewals(false)
+		}
+	}
+}
+
+// renewsACME reports whether the listener renews ACME certificates, which
+// read-only replicas and static certificates never do
+func (tl *TLSListener) renewsACME() bool {
+	return !tl.readOnly && tl.staticCert == nil
+}
+
+// checkAllRenewals runs one renewal check for every domain, or only those
+// with a cached certificate if cachedOnly is set, unless renewal is paused
+// or the listener is closing
+func (tl *TLSListener) checkAllRenewals(cachedOnly bool) {
+	var anyDue bool
+	var firstErr error
+	if tl.onRenewalCheck != nil {
+		defer func() { tl.onRenewalCheck(anyDue, firstErr) }()
+	}
+
+	if tl.renewalPaused.Load() {
+		tl.logf("Renewal is paused; skipping renewal checks")
+		return
+	}
+
+	for _, domain := range tl.domains() {
+		select {
+		case <-tl.done:
+			return
+		default:
+		}
+		if cachedOnly && !tl.HasCachedCert(domain) {
 			continue
 		}
+		due, err := tl.checkRenewalSafely(domain)
+		anyDue = anyDue || due
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+}
+
+// PauseRenewal stops the renewal routine from checking or renewing
+// certificates, e.g. during a maintenance window, until ResumeRenewal is
+// called. The listener keeps serving the cached certificates.
+func (tl *TLSListener) PauseRenewal() {
+	tl.renewalPaused.Store(true)
+}
+
+// ResumeRenewal undoes PauseRenewal; checks resume at the next daily tick
+func (tl *TLSListener) ResumeRenewal() {
+	tl.renewalPaused.Store(false)
+}
+
+// checkRenewalSafely runs checkRenewal, recovering from any panic so that
+// one bad check or callback cannot stop renewal for good
+func (tl *TLSListener) checkRenewalSafely(domain string) (due bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			tl.logf("Panic while checking renewal for %s: %v\n%s", domain, r, debug.Stack())
+			if tl.onPanic != nil {
+				tl.onPanic(r)
+			}
+			err = errors.Errorf("panic while checking renewal for %s: %v", domain, r)
+		}
+	}()
+	return tl.checkRenewal(domain)
+}
+
+// checkRenewal renews domain's certificate if its renewal policy says so.
+// It reports whether the certificate was due and any error on the way.
+func (tl *TLSListener) checkRenewal(domain string) (bool, error) {
+	// Disabled domains keep their cached certificate as it is
+	if tl.domainDisabled(domain) {
+		return false, nil
+	}
+
+	if tl.renewalLeaseTTL > 0 {
+		tl.reloadRenewedCert(domain)
+	}
+
+	shouldRenew, err := tl.shouldRenew(domain)
+	if err != nil {
+		tl.logf("Failed to check certificate renewal status for %s: %v", domain, err)
+		tl.renewError(domain, err)
+		return false, err
+	}
+
+	if shouldRenew {
+		if limited, until := tl.RateLimited(); limited {
+			tl.logf("Skipping renewal of %s: rate-limited until %v", domain, until)
+			return true, nil
+		}
+
+		if tl.renewalLeaseTTL > 0 {
+			release, err := tl.renewalLease(domain)
+			if err != nil {
+				tl.logf("Failed to acquire renewal lease for %s: %v", domain, err)
+				tl.renewError(domain, err)
+				return true, err
+			}
+			if release == nil {
+				return true, nil
+			}
+			defer release()
+		}
+
+		if err := tl.renewCertificates(domain); err != nil {
+			tl.logf("Failed to renew certificates for %s: %v", domain, err)
+			tl.renewError(domain, err)
+			return true, err
+		}
+		tl.recordRenewal(domain)
+		tl.logf("Successfully renewed certificates for %s", domain)
+	}
+	return shouldRenew, nil
+}
 
-		if shouldRenew {
-			if err := tl.renewCertificates(); err != nil {
-				logf("Failed to renew certificates: %v", err)
-			} else {
-				logf("Successfully renewed certificates for %s", tl.domain)
+// recordRenewal notes that domain was just renewed successfully
+func (tl *TLSListener) recordRenewal(domain string) {
+	tl.mu.Lock()
+	tl.lastRenewal[normalizeDomain(domain)] = tl.now()
+	tl.mu.Unlock()
+
+	if normalizeDomain(domain) == normalizeDomain(tl.domain) {
+		tl.checkReady()
+	}
+}
+
+// LastRenewal returns when the renewal routine last successfully renewed
+// domain's certificate. Unlike the certificate's NotBefore, this is updated
+// even when the renewal was satisfied from the cache. The bool is false if
+// no renewal has happened since the listener started.
+func (tl *TLSListener) LastRenewal(domain string) (time.Time, bool) {
+	tl.mu.RLock()
+	defer tl.mu.RUnlock()
+	t, ok := tl.lastRenewal[normalizeDomain(domain)]
+	return t, ok
+}
+
+// renewError reports a renewal problem to Config.OnRenewError, if set
+func (tl *TLSListener) renewError(domain string, err error) {
+	if tl.onRenewError != nil {
+		tl.onRenewError(domain, err)
+	}
+}
+
+// withWWW returns domains plus the www/apex counterpart of each entry.
+// Wildcards and IP addresses have no counterpart and are left alone.
+func withWWW(domains []string) []string {
+	result := append([]string(nil), domains...)
+	for _, domain := range domains {
+		domain = normalizeDomain(domain)
+		if strings.HasPrefix(domain, "*.") || net.ParseIP(domain) != nil {
+			continue
+		}
+		if apex := strings.TrimPrefix(domain, "www."); apex != domain {
+			if strings.Contains(apex, ".") {
+				result = append(result, apex)
 			}
+		} else {
+			result = append(result, "www."+domain)
+		}
+	}
+	return result
+}
+
+// domains returns the distinct domains the listener serves, primary first.
+// Wildcard entries are left out: no certificate can be ordered for them, and
+// the names they match are renewed by autocert as they come up.
+func (tl *TLSListener) domains() []string {
+	tl.mu.RLock()
+	defer tl.mu.RUnlock()
+
+	seen := make(map[string]bool, len(tl.allowedDomains))
+	domains := make([]string, 0, len(tl.allowedDomains))
+	for _, domain := range tl.allowedDomains {
+		domain = normalizeDomain(domain)
+		if domain == "" || seen[domain] || strings.HasPrefix(domain, "*.") {
+			continue
 		}
+		seen[domain] = true
+		domains = append(domains, domain)
 	}
+	return domains
 }
 
-// renewCertificates forces certificate renewal
-func (tl *TLSListener) renewCertificates() error {
+// renewCertificates forces certificate renewal for domain
+func (tl *TLSListener) renewCertificates(domain string) error {
 	tl.mu.RLock()
 	manager := tl.certManager
 	tl.mu.RUnlock()
@@ -232,16 +1694,86 @@ func (tl *TLSListener) renewCertificates() error {
 		return errors.New("cert manager is not initialized")
 	}
 
-	// Force renewal by getting a new certificate
-	_, err := manager.GetCertificate(&tls.ClientHelloInfo{
-		ServerName: tl.domain,
-	})
+	var previous []byte
+	if tl.keepOldCerts > 0 {
+		previous, _ = manager.Cache.Get(context.Background(), tl.cacheKey(domain))
+	}
+
+	// Force renewal by ordering a new certificate
+	err := tl.forceRenew(domain)
+
+	tl.mu.Lock()
+	tl.lastRenewalErr = err
+	tl.mu.Unlock()
+	if err != nil {
+		tl.noteRateLimit(domain, err)
+	}
 
+	if tl.keepOldCerts > 0 {
+		if err == nil && previous != nil {
+			tl.archiveCert(manager.Cache, tl.cacheKey(domain), previous)
+		}
+		tl.pruneOldCerts()
+	}
 	return err
 }
 
-// logf is a helper function for logging
-// In production, you might want to replace this with a proper logger
+// Logger is the interface Config.Logger must satisfy; *log.Logger does
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// logf logs through Config.Logger, or to stdout if none was configured
+func (tl *TLSListener) logf(format string, args ...interface{}) {
+	if tl.logger != nil {
+		tl.logger.Printf(format, args...)
+		return
+	}
+	if tl.jsonLogs {
+		jsonLogf(tl.domain, tl.metricsLabels, format, args...)
+		return
+	}
+	logf(format, args...)
+}
+
+// logEntry is one line of JSONLogs output
+type logEntry struct {
+	TS     string            `json:"ts"`
+	Level  string            `json:"level"`
+	Msg    string            `json:"msg"`
+	Domain string            `json:"domain"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// jsonLogf writes a log line to stdout as a JSON object. The level is
+// inferred from the message, domain is the listener's primary domain and
+// labels are its MetricsLabels.
+func jsonLogf(domain string, labels map[string]string, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	level := "info"
+	switch {
+	case strings.HasPrefix(msg, "WARNING: "):
+		level = "warn"
+		msg = strings.TrimPrefix(msg, "WARNING: ")
+	case strings.HasPrefix(msg, "Failed"), strings.HasPrefix(msg, "Panic"):
+		level = "error"
+	}
+
+	line, err := json.Marshal(logEntry{
+		TS:     time.Now().UTC().Format(time.RFC3339Nano),
+		Level:  level,
+		Msg:    msg,
+		Domain: domain,
+		Labels: labels,
+	})
+	if err != nil {
+		logf(format, args...)
+		return
+	}
+	fmt.Println(string(line))
+}
+
+// logf is the default logger, used when Config.Logger is unset
 func logf(format string, args ...interface{}) {
 	fmt.Printf(format+"\n", args...)
 }
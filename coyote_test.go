@@ -0,0 +1,288 @@
+package tlslistener
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// blockingCloseListener is a net.Listener whose Close blocks until release
+// is closed
+type blockingCloseListener struct {
+	net.Listener
+	release chan struct{}
+}
+
+func (l *blockingCloseListener) Close() error {
+	<-l.release
+	return l.Listener.Close()
+}
+
+func TestCloseTimeoutBoundsBlockedChallengeServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := &blockingCloseListener{Listener: ln, release: make(chan struct{})}
+	defer close(challenge.release)
+	tl := newTestListener(t, Config{Certificate: testCert(t, testDomain), HTTPChallengeListener: challenge})
+
+	go tl.ServeHTTPChallenges(http.NotFoundHandler())
+	waitFor(t, "the challenge server", func() bool {
+		tl.mu.Lock()
+		defer tl.mu.Unlock()
+		return len(tl.challengeServers) == 1
+	})
+	// Let Serve start tracking the listener, so that closing the server
+	// reaches its Close
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	if err := tl.CloseTimeout(50 * time.Millisecond); err == nil {
+		t.Fatal("CloseTimeout returned success while the challenge listener was blocked")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("CloseTimeout took %v", elapsed)
+	}
+
+	// Nothing may be left holding the listener's lock
+	errc := make(chan error, 1)
+	go func() {
+		_, err := tl.AdditionalListener("127.0.0.1:0")
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		if err != ErrListenerClosed {
+			t.Fatalf("AdditionalListener after Close: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a blocked challenge server held the listener's lock")
+	}
+}
+
+func TestConcurrentAcceptDistributesAndCloseUnblocksAll(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		base bool
+	}{{"ListenAddr", false}, {"BaseListener", true}} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{Certificate: testCert(t, testDomain)}
+			if tt.base {
+				ln, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				cfg.BaseListener = ln
+			}
+			tl := newTestListener(t, cfg)
+
+			const acceptors, conns = 16, 64
+			type acceptance struct {
+				acceptor int
+				c        net.Conn
+			}
+			accepted := make(chan acceptance, conns)
+			errs := make(chan error, acceptors)
+			for i := 0; i < acceptors; i++ {
+				go func(acceptor int) {
+					for {
+						c, err := tl.Accept()
+						if err != nil {
+							errs <- err
+							return
+						}
+						accepted <- acceptance{acceptor, c}
+						// Stand in for handling the connection, as a pool would
+						time.Sleep(10 * time.Millisecond)
+					}
+				}(i)
+			}
+
+			for i := 0; i < conns; i++ {
+				c, err := net.Dial("tcp", tl.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer c.Close()
+			}
+			seen := make(map[string]bool)
+			served := make(map[int]bool)
+			for i := 0; i < conns; i++ {
+				select {
+				case a := <-accepted:
+					addr := a.c.RemoteAddr().String()
+					if seen[addr] {
+						t.Fatalf("connection from %s accepted twice", addr)
+					}
+					seen[addr] = true
+					served[a.acceptor] = true
+					a.c.Close()
+				case <-time.After(5 * time.Second):
+					t.Fatalf("only %d of %d connections accepted", i, conns)
+				}
+			}
+			if len(served) < acceptors/2 {
+				t.Fatalf("%d connections went to only %d of %d acceptors", conns, len(served), acceptors)
+			}
+
+			if err := tl.Close(); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < acceptors; i++ {
+				select {
+				case err := <-errs:
+					if err != ErrListenerClosed {
+						t.Fatalf("Accept after Close: %v, want ErrListenerClosed", err)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("Close left %d of %d Accept calls blocked", acceptors-i, acceptors)
+				}
+			}
+		})
+	}
+}
+
+// openFDs returns how many file descriptors the process has open
+func openFDs(t *testing.T) int {
+	t.Helper()
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skipf("cannot count open files: %v", err)
+	}
+	return len(entries)
+}
+
+func TestNewReleasesListenerOnLateFailure(t *testing.T) {
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := probe.Addr().String()
+	probe.Close()
+
+	// A seed for another domain only fails once the socket is bound
+	certPEM, keyPEM := testCertPEM(t, newECDSAKey(t), time.Now().Add(-time.Hour), time.Now().Add(90*24*time.Hour), "other.example.org")
+	cfg := Config{
+		Domain:         testDomain,
+		CertDir:        t.TempDir(),
+		DirectoryURL:   unreachableCA,
+		ListenAddr:     addr,
+		InitialCertPEM: certPEM,
+		InitialKeyPEM:  keyPEM,
+	}
+	before := openFDs(t)
+	if tl, err := New(cfg); err == nil {
+		tl.Close()
+		t.Fatal("New accepted a seed for another domain")
+	}
+	if after := openFDs(t); after > before {
+		t.Fatalf("failed New left %d file descriptors open", after-before)
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("address still bound after a failed New: %v", err)
+	}
+	ln.Close()
+}
+
+func TestNewLeavesBaseListenerOpenOnFailure(t *testing.T) {
+	base, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer base.Close()
+
+	certPEM, keyPEM := testCertPEM(t, newECDSAKey(t), time.Now().Add(-time.Hour), time.Now().Add(90*24*time.Hour), "other.example.org")
+	if tl, err := New(Config{
+		Domain:         testDomain,
+		CertDir:        t.TempDir(),
+		DirectoryURL:   unreachableCA,
+		BaseListener:   base,
+		InitialCertPEM: certPEM,
+		InitialKeyPEM:  keyPEM,
+	}); err == nil {
+		tl.Close()
+		t.Fatal("New accepted a seed for another domain")
+	}
+
+	// The caller still owns the base listener and can serve from it
+	go func() {
+		if c, err := net.Dial("tcp", base.Addr().String()); err == nil {
+			c.Close()
+		}
+	}()
+	c, err := base.Accept()
+	if err != nil {
+		t.Fatalf("failed New closed the caller's BaseListener: %v", err)
+	}
+	c.Close()
+}
+
+func TestRenewBeforeIgnoresCertificateAge(t *testing.T) {
+	now := time.Now()
+	tl := newTestListener(t, Config{RenewBefore: 24 * time.Hour})
+
+	// A young, short-lived certificate is due as soon as it is inside
+	// RenewBefore of expiry
+	certPEM, keyPEM := testCertPEM(t, newECDSAKey(t), now.Add(-time.Hour), now.Add(12*time.Hour), testDomain)
+	putCert(t, tl, testDomain, certPEM, keyPEM)
+	if renew, err := tl.shouldRenew(testDomain); err != nil || !renew {
+		t.Fatalf("shouldRenew = %t, %v for a certificate expiring in 12h", renew, err)
+	}
+
+	// An old certificate far from expiry is not, whatever its age
+	old := &CertInfo{NotBefore: now.AddDate(0, -3, 0), NotAfter: now.AddDate(0, 0, 60)}
+	if renewAt := tl.renewalTime(testDomain, old); !renewAt.Equal(old.NotAfter.Add(-24 * time.Hour)) {
+		t.Fatalf("renewalTime = %v, want RenewBefore ahead of expiry %v", renewAt, old.NotAfter)
+	}
+
+	// Without RenewBefore, the age rule still applies
+	defaults := newTestListener(t, Config{})
+	if renewAt := defaults.renewalTime(testDomain, old); !renewAt.Equal(old.NotBefore.AddDate(0, 2, 0)) {
+		t.Fatalf("renewalTime = %v, want two months after issuance", renewAt)
+	}
+}
+
+func TestAdditionalListenerBindsOutsideLock(t *testing.T) {
+	binding := make(chan struct{})
+	release := make(chan struct{})
+	var calls atomic.Int32
+	tl := newTestListener(t, Config{
+		Certificate: testCert(t, testDomain),
+		ControlFunc: func(network, address string, c syscall.RawConn) error {
+			// The first call binds the listener itself
+			if calls.Add(1) == 2 {
+				close(binding)
+				<-release
+			}
+			return nil
+		},
+	})
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := tl.AdditionalListener("127.0.0.1:0")
+		errc <- err
+	}()
+	<-binding
+
+	closed := make(chan error, 1)
+	go func() { closed <- tl.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		close(release)
+		t.Fatal("Close waited on a bind in progress")
+	}
+
+	close(release)
+	if err := <-errc; err != ErrListenerClosed {
+		t.Fatalf("AdditionalListener racing Close: %v, want ErrListenerClosed", err)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+
+package tlslistener
+
+import "github.com/pkg/errors"
+
+// diskFree is not supported on this platform
+func diskFree(path string) (int64, error) {
+	return 0, errors.New("disk space reporting is not supported on this platform")
+}
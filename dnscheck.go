@@ -0,0 +1,77 @@
+package tlslistener
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// dnsCheckTimeout bounds the lookup of one domain during the VerifyDNS
+// preflight
+const dnsCheckTimeout = 10 * time.Second
+
+// verifyDNS resolves every allowed domain, failing on names that do not
+// resolve and warning about names that resolve only to addresses this host
+// does not have
+func (tl *TLSListener) verifyDNS() error {
+	local, err := localAddrs()
+	if err != nil {
+		tl.logf("VerifyDNS: cannot list local addresses, skipping address check: %v", err)
+	}
+
+	for _, domain := range tl.domains() {
+		addrs, err := lookupDomain(domain)
+		if err != nil {
+			return errors.Wrapf(err, "domain %s does not resolve; ACME validation would fail", domain)
+		}
+		if local == nil || resolvesLocally(addrs, local) {
+			continue
+		}
+		tl.logf("WARNING: %s resolves to %v, none of which is a local address; "+
+			"ACME validation will fail unless traffic is forwarded here", domain, addrs)
+	}
+	return nil
+}
+
+// lookupDomain resolves domain to its IP addresses
+func lookupDomain(domain string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsCheckTimeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
+
+// localAddrs returns the addresses of all local interfaces
+func localAddrs() (map[string]bool, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	local := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			local[ipNet.IP.String()] = true
+		}
+	}
+	return local, nil
+}
+
+// resolvesLocally reports whether any of addrs is in local
+func resolvesLocally(addrs []net.IP, local map[string]bool) bool {
+	for _, ip := range addrs {
+		if local[ip.String()] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,361 @@
+package tlslistener
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/idna"
+)
+
+// DisableDomain stops serving domain, e.g. while a tenant is suspended.
+// Handshakes for it fail, but its certificate stays in the cache so that
+// EnableDomain brings it back without a new issuance.
+func (tl *TLSListener) DisableDomain(domain string) {
+	tl.mu.Lock()
+	tl.disabledDomains[normalizeDomain(domain)] = true
+	tl.anyDisabled.Store(true)
+	tl.mu.Unlock()
+}
+
+// EnableDomain resumes serving a domain disabled with DisableDomain
+func (tl *TLSListener) EnableDomain(domain string) {
+	tl.mu.Lock()
+	delete(tl.disabledDomains, normalizeDomain(domain))
+	tl.anyDisabled.Store(len(tl.disabledDomains) > 0)
+	tl.mu.Unlock()
+}
+
+// domainDisabled reports whether domain has been disabled
+func (tl *TLSListener) domainDisabled(domain string) bool {
+	if !tl.anyDisabled.Load() {
+		return false
+	}
+	tl.mu.RLock()
+	defer tl.mu.RUnlock()
+	return tl.disabledDomains[normalizeDomain(domain)]
+}
+
+// hostPolicy returns the autocert HostPolicy: the allowed domains, minus
+// any that are currently disabled, up to MaxDomains of them
+func (tl *TLSListener) hostPolicy() autocert.HostPolicy {
+	return func(ctx context.Context, host string) error {
+		return tl.checkHost(ctx, tl.currentWhitelist(), host, true)
+	}
+}
+
+// currentWhitelist returns the policy matching the allowed domains
+func (tl *TLSListener) currentWhitelist() autocert.HostPolicy {
+	tl.mu.RLock()
+	defer tl.mu.RUnlock()
+	return tl.whitelist
+}
+
+// setFileDomains replaces the domains read from DomainsFile
+func (tl *TLSListener) setFileDomains(fileDomains []string) {
+	tl.mu.Lock()
+	tl.fileDomains = fileDomains
+	tl.rebuildAllowedDomains()
+	tl.mu.Unlock()
+}
+
+// addDomain allows domain in addition to the configured and file domains
+func (tl *TLSListener) addDomain(domain string) {
+	domain = normalizeDomain(domain)
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	for _, added := range tl.addedDomains {
+		if added == domain {
+			return
+		}
+	}
+	tl.addedDomains = append(tl.addedDomains, domain)
+	tl.rebuildAllowedDomains()
+}
+
+// rebuildAllowedDomains makes the allowed domains the configured ones plus
+// those read from DomainsFile and added with PrepareDomain, with their www
+// counterparts under IncludeWWW. tl.mu must be held.
+func (tl *TLSListener) rebuildAllowedDomains() {
+	domains := append(append([]string(nil), tl.configDomains...), tl.fileDomains...)
+	domains = append(domains, tl.addedDomains...)
+	if tl.includeWWW {
+		domains = withWWW(domains)
+	}
+	tl.allowedDomains = domains
+	tl.whitelist = hostWhitelist(domains)
+}
+
+// PrepareDomain allows domain and obtains its certificate straight away,
+// returning once it is cached, so a new domain can go live without its
+// first clients waiting on issuance. ctx bounds the wait; issuance that is
+// already under way carries on in the background. The domain stays allowed
+// even if issuance fails, and later handshakes retry it.
+func (tl *TLSListener) PrepareDomain(ctx context.Context, domain string) error {
+	if err := validDomainEntry(domain); err != nil {
+		return err
+	}
+	if strings.HasPrefix(domain, "*.") {
+		return errors.Errorf("cannot prepare wildcard %q; its names are issued on demand", domain)
+	}
+	if tl.readOnly {
+		return errors.Wrapf(errReadOnly, "cannot prepare %s", domain)
+	}
+	if tl.staticCert != nil {
+		return errors.Errorf("cannot prepare %s: a static Certificate is configured", domain)
+	}
+
+	tl.addDomain(domain)
+
+	type result struct {
+		cert *tls.Certificate
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		cert, err := tl.autocertCertificate(helloFor(normalizeDomain(domain)))
+		done <- result{cert, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return errors.Wrapf(r.err, "failed to obtain certificate for %s", domain)
+		}
+		return nil
+	case <-ctx.Done():
+		return errors.Wrapf(ctx.Err(), "timed out obtaining certificate for %s", domain)
+	}
+}
+
+// Obtain prepares each of domains in turn, as PrepareDomain does, for bulk
+// onboarding. After each one, progress, if non-nil, is called with the
+// domain, how many of the total are done and the error it failed with, if
+// any. Domains are obtained one at a time to stay clear of CA rate limits.
+// Cancelling ctx stops Obtain before the next domain; the domains it never
+// got to are in neither list, and ctx's error is returned.
+func (tl *TLSListener) Obtain(ctx context.Context, domains []string,
+	progress func(domain string, done, total int, err error)) (succeeded, failed []string, err error) {
+	for i, domain := range domains {
+		if err := ctx.Err(); err != nil {
+			return succeeded, failed, errors.Wrapf(err, "stopped after %d of %d domains", i, len(domains))
+		}
+
+		prepErr := tl.PrepareDomain(ctx, domain)
+		if prepErr != nil {
+			failed = append(failed, domain)
+		} else {
+			succeeded = append(succeeded, domain)
+		}
+		if progress != nil {
+			progress(domain, i+1, len(domains), prepErr)
+		}
+	}
+	return succeeded, failed, nil
+}
+
+// hostWhitelist is like autocert.HostWhitelist, but also accepts wildcard
+// entries: "*.example.com" allows any name exactly one label below
+// example.com, such as "a.example.com", but neither "example.com" itself nor
+// "a.b.example.com". Each matching name still gets its own certificate, as
+// tls-alpn-01 and http-01 cannot validate wildcard certificates. Specific
+// entries are matched as well, so a name may be listed both ways.
+func hostWhitelist(domains []string) autocert.HostPolicy {
+	exact := make(map[string]bool, len(domains))
+	wildcards := make(map[string]bool)
+	for _, domain := range domains {
+		domain = normalizeDomain(domain)
+		set := exact
+		if strings.HasPrefix(domain, "*.") {
+			domain, set = domain[2:], wildcards
+		}
+		if ascii, err := idna.Lookup.ToASCII(domain); err == nil {
+			set[ascii] = true
+		}
+	}
+
+	return func(_ context.Context, host string) error {
+		host = normalizeDomain(host)
+		if exact[host] {
+			return nil
+		}
+		if i := strings.IndexByte(host, '.'); i > 0 && wildcards[host[i+1:]] {
+			return nil
+		}
+		return errors.Errorf("host %q is not in AllowedDomains", host)
+	}
+}
+
+// hostRejected returns the host policy's verdict on host without counting
+// it against MaxDomains
+func (tl *TLSListener) hostRejected(ctx context.Context, host string) error {
+	return tl.checkHost(ctx, tl.currentWhitelist(), host, false)
+}
+
+// renewalHostPolicy is the host policy of renewal orders. A domain that is
+// configured, or already has a certificate in cache, is renewed without
+// counting against MaxDomains, which would otherwise let its certificate
+// lapse once the cap is reached by others.
+func (tl *TLSListener) renewalHostPolicy(cache autocert.Cache) autocert.HostPolicy {
+	return func(ctx context.Context, host string) error {
+		domain := normalizeDomain(host)
+		if tl.maxDomains > 0 && !tl.domainDisabled(domain) &&
+			(tl.isConfigured(domain) || cacheHasCert(ctx, cache, domain)) {
+			return tl.currentWhitelist()(ctx, host)
+		}
+		return tl.checkHost(ctx, tl.currentWhitelist(), host, true)
+	}
+}
+
+// isConfigured reports whether domain is one of the allowed domains proper,
+// rather than a name matched by a wildcard entry
+func (tl *TLSListener) isConfigured(domain string) bool {
+	for _, d := range tl.domains() {
+		if d == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHost applies the host policy to host. With reserve set, an accepted
+// host is counted against MaxDomains; autocert only consults the policy
+// before ordering a certificate, so this caps the distinct domains this
+// listener will order certificates for.
+func (tl *TLSListener) checkHost(ctx context.Context, whitelist autocert.HostPolicy, host string, reserve bool) error {
+	if tl.domainDisabled(host) {
+		return errors.Errorf("domain %q is disabled", host)
+	}
+	if err := whitelist(ctx, host); err != nil {
+		return err
+	}
+	if tl.maxDomains <= 0 {
+		return nil
+	}
+
+	host = normalizeDomain(host)
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	if tl.orderedDomains[host] {
+		return nil
+	}
+	if len(tl.orderedDomains) >= tl.maxDomains {
+		if reserve {
+			tl.logf("Refusing to obtain a certificate for %s: MaxDomains (%d) reached", host, tl.maxDomains)
+		}
+		return errors.Errorf("refusing %q: certificate limit of %d domains reached", host, tl.maxDomains)
+	}
+	if reserve {
+		tl.orderedDomains[host] = true
+	}
+	return nil
+}
+
+// rejectLogLimit caps how many host policy rejections are logged per
+// rejectLogWindow; the rest are counted and summarised
+const (
+	rejectLogLimit  = 10
+	rejectLogWindow = time.Minute
+)
+
+// rejectLogLimiter rate-limits rejection logging so a scanner sweeping
+// hostnames cannot flood the log
+type rejectLogLimiter struct {
+	mu          sync.Mutex
+	windowStart time.Time
+	logged      int
+	suppressed  int
+}
+
+// allow reports whether a rejection seen at now may be logged, along with
+// how many were suppressed in the window that just ended
+func (l *rejectLogLimiter) allow(now time.Time) (ok bool, suppressed int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.windowStart) >= rejectLogWindow {
+		suppressed = l.suppressed
+		l.windowStart = now
+		l.logged = 0
+		l.suppressed = 0
+	}
+	if l.logged >= rejectLogLimit {
+		l.suppressed++
+		return false, suppressed
+	}
+	l.logged++
+	return true, suppressed
+}
+
+// logRejectedHost logs a handshake that failed because the host policy
+// rejected its SNI hostname, if Config.LogRejectedHosts is set
+func (tl *TLSListener) logRejectedHost(hello *tls.ClientHelloInfo) {
+	if !tl.logRejectedHosts || isChallengeHello(hello) {
+		return
+	}
+
+	err := tl.hostRejected(helloContext(hello), normalizeDomain(hello.ServerName))
+	if err == nil {
+		return
+	}
+
+	ok, suppressed := tl.rejectLog.allow(tl.now())
+	if suppressed > 0 {
+		tl.logf("Suppressed %d further rejected hostnames in the last %v", suppressed, rejectLogWindow)
+	}
+	if !ok {
+		return
+	}
+
+	remote := "unknown"
+	if hello.Conn != nil {
+		remote = hello.Conn.RemoteAddr().String()
+	}
+	tl.logf("Rejected hostname %q from %s: %v", hello.ServerName, remote, err)
+}
+
+// Explain reports whether a handshake for host would be served and why,
+// walking the same checks as the certificate lookup: disabled domains,
+// internal domains, a static certificate, the cache, AllowedDomains and
+// MaxDomains. It has no side effects, so it neither orders a certificate
+// nor consults ApproveIssuance or FallbackGetCertificate.
+func (tl *TLSListener) Explain(host string) (allowed bool, reason string) {
+	domain := normalizeDomain(host)
+	switch {
+	case domain == "":
+		return false, "no server name given"
+	case tl.domainDisabled(domain):
+		return false, "domain is disabled with DisableDomain"
+	case tl.internalDomains[domain]:
+		return true, "internal domain, served with the internal certificate"
+	case tl.staticCert != nil:
+		return true, "served with the static Certificate"
+	case tl.HasCachedCert(domain):
+		return true, "certificate is cached"
+	case tl.readOnly:
+		return false, "no cached certificate, and the cache is read-only"
+	}
+
+	if err := tl.hostRejected(context.Background(), domain); err != nil {
+		reason = err.Error()
+		if tl.fallbackGetCert != nil {
+			reason += "; FallbackGetCertificate may still serve it"
+		}
+		return false, reason
+	}
+
+	reason = "allowed; a certificate will be ordered on first handshake"
+	if tl.approveIssuance != nil {
+		reason += ", subject to ApproveIssuance"
+	}
+	if limited, until := tl.RateLimited(); limited {
+		reason += fmt.Sprintf(", though the CA rate-limited us until %v", until)
+	}
+	return true, reason
+}
@@ -0,0 +1,79 @@
+package tlslistener
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRenewalExemptFromMaxDomains(t *testing.T) {
+	tl := newTestListener(t, Config{
+		AllowedDomains: []string{"*.example.com"},
+		MaxDomains:     1,
+	})
+	ctx := context.Background()
+	cache := tl.managerSnap.Load().Cache
+
+	// Fill the cap with a name issued on demand
+	if err := tl.hostPolicy()(ctx, "a.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tl.hostPolicy()(ctx, "b.example.com"); err == nil {
+		t.Fatal("MaxDomains did not cap new domains")
+	}
+
+	policy := tl.renewalHostPolicy(cache)
+	if err := policy(ctx, testDomain); err != nil {
+		t.Fatalf("renewal of the configured domain refused: %v", err)
+	}
+
+	certPEM, keyPEM := testCertPEM(t, newECDSAKey(t), time.Now().Add(-time.Hour), time.Now().Add(90*24*time.Hour), "c.example.com")
+	putCert(t, tl, "c.example.com", certPEM, keyPEM)
+	if err := policy(ctx, "c.example.com"); err != nil {
+		t.Fatalf("renewal of a cached domain refused: %v", err)
+	}
+
+	if err := policy(ctx, "d.example.com"); err == nil {
+		t.Fatal("renewal policy let a new domain past MaxDomains")
+	}
+	if err := policy(ctx, "other.example.org"); err == nil {
+		t.Fatal("renewal policy let a domain outside AllowedDomains through")
+	}
+}
+
+func TestSpecificAndWildcardDomainsOverlap(t *testing.T) {
+	tl := newTestListener(t, Config{
+		Domain:         "a.example.com",
+		AllowedDomains: []string{"*.example.com", "b.example.com", "shop.example.org"},
+	})
+	ctx := context.Background()
+	policy := tl.hostPolicy()
+
+	for _, host := range []string{
+		"a.example.com",    // Domain, also matched by the wildcard
+		"b.example.com",    // listed explicitly and by the wildcard
+		"c.example.com",    // the wildcard alone
+		"shop.example.org", // listed explicitly only
+	} {
+		if err := policy(ctx, host); err != nil {
+			t.Errorf("%s rejected: %v", host, err)
+		}
+	}
+	for _, host := range []string{
+		"example.com",     // a wildcard does not cover its parent
+		"x.y.example.com", // nor more than one label
+		"www.shop.example.org",
+		"other.example.net",
+	} {
+		if err := policy(ctx, host); err == nil {
+			t.Errorf("%s allowed", host)
+		}
+	}
+
+	if tl.isConfigured("c.example.com") {
+		t.Error("a name matched by a wildcard counted as configured")
+	}
+	if !tl.isConfigured("b.example.com") {
+		t.Error("a name listed alongside a wildcard not counted as configured")
+	}
+}
@@ -0,0 +1,120 @@
+package tlslistener
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/idna"
+)
+
+// domainsFilePollInterval is how often DomainsFile is checked for changes
+const domainsFilePollInterval = 10 * time.Second
+
+// readDomainsFile parses DomainsFile: one domain per line, with blank
+// lines and "#" comments ignored. Invalid entries are skipped with a
+// warning rather than failing the whole file.
+func (tl *TLSListener) readDomainsFile() ([]string, error) {
+	data, err := os.ReadFile(tl.domainsFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read domains file")
+	}
+
+	var domains []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		entry := scanner.Text()
+		if i := strings.IndexByte(entry, '#'); i >= 0 {
+			entry = entry[:i]
+		}
+		entry = normalizeDomain(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if err := validDomainEntry(entry); err != nil {
+			tl.logf("WARNING: skipping %s line %d: %v", tl.domainsFile, line, err)
+			continue
+		}
+		domains = append(domains, entry)
+	}
+	return domains, scanner.Err()
+}
+
+// validDomainEntry checks that entry is a plain or single-label wildcard
+// domain name
+func validDomainEntry(entry string) error {
+	name := strings.TrimPrefix(entry, "*.")
+	if strings.ContainsAny(name, " \t*/:") || !strings.Contains(name, ".") {
+		return errors.Errorf("invalid domain %q", entry)
+	}
+	if _, err := idna.Lookup.ToASCII(name); err != nil {
+		return errors.Wrapf(err, "invalid domain %q", entry)
+	}
+	return nil
+}
+
+// watchDomainsFile polls DomainsFile and applies its contents whenever it
+// changes, until the listener is closed
+func (tl *TLSListener) watchDomainsFile() {
+	ticker := time.NewTicker(domainsFilePollInterval)
+	defer ticker.Stop()
+
+	var lastMod time.Time
+	var lastSize int64 = -1
+	if fi, err := os.Stat(tl.domainsFile); err == nil {
+		lastMod, lastSize = fi.ModTime(), fi.Size()
+	}
+
+	for {
+		select {
+		case <-tl.done:
+			return
+		case <-ticker.C:
+		}
+
+		fi, err := os.Stat(tl.domainsFile)
+		if err != nil {
+			// Keep the current domains while the file is missing, e.g.
+			// mid-replacement
+			continue
+		}
+		if fi.ModTime().Equal(lastMod) && fi.Size() == lastSize {
+			continue
+		}
+		lastMod, lastSize = fi.ModTime(), fi.Size()
+
+		fileDomains, err := tl.readDomainsFile()
+		if err != nil {
+			tl.logf("Failed to reload domains file: %v", err)
+			continue
+		}
+		tl.reloadFileDomains(fileDomains)
+	}
+}
+
+// reloadFileDomains applies a fresh read of DomainsFile and logs what it
+// added and removed
+func (tl *TLSListener) reloadFileDomains(fileDomains []string) {
+	before := make(map[string]bool)
+	for _, domain := range tl.domains() {
+		before[domain] = true
+	}
+
+	tl.setFileDomains(fileDomains)
+
+	after := make(map[string]bool)
+	for _, domain := range tl.domains() {
+		after[domain] = true
+		if !before[domain] {
+			tl.logf("Domains file added %s", domain)
+		}
+	}
+	for domain := range before {
+		if !after[domain] {
+			tl.logf("Domains file removed %s", domain)
+		}
+	}
+}
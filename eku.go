@@ -0,0 +1,51 @@
+package tlslistener
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+
+	"github.com/pkg/errors"
+)
+
+// extKeyUsageOID is the extended key usage extension (RFC 5280 4.2.1.12)
+var extKeyUsageOID = asn1.ObjectIdentifier{2, 5, 29, 37}
+
+// serverExtKeyUsages maps the usages that may be requested for a TLS server
+// certificate to their OIDs. Usages such as code signing or OCSP signing are
+// left out: no CA issues them alongside server authentication.
+var serverExtKeyUsages = map[x509.ExtKeyUsage]asn1.ObjectIdentifier{
+	x509.ExtKeyUsageServerAuth:                 {1, 3, 6, 1, 5, 5, 7, 3, 1},
+	x509.ExtKeyUsageClientAuth:                 {1, 3, 6, 1, 5, 5, 7, 3, 2},
+	x509.ExtKeyUsageIPSECEndSystem:             {1, 3, 6, 1, 5, 5, 7, 3, 5},
+	x509.ExtKeyUsageIPSECTunnel:                {1, 3, 6, 1, 5, 5, 7, 3, 6},
+	x509.ExtKeyUsageIPSECUser:                  {1, 3, 6, 1, 5, 5, 7, 3, 7},
+	x509.ExtKeyUsageMicrosoftServerGatedCrypto: {1, 3, 6, 1, 4, 1, 311, 10, 3, 3},
+	x509.ExtKeyUsageNetscapeServerGatedCrypto:  {2, 16, 840, 1, 113730, 4, 1},
+}
+
+// extKeyUsageExtension builds the CSR extension requesting usages, which
+// must include server authentication
+func extKeyUsageExtension(usages []x509.ExtKeyUsage) (pkix.Extension, error) {
+	oids := make([]asn1.ObjectIdentifier, 0, len(usages))
+	seen := make(map[x509.ExtKeyUsage]bool, len(usages))
+	for _, usage := range usages {
+		oid, ok := serverExtKeyUsages[usage]
+		if !ok {
+			return pkix.Extension{}, errors.Errorf("extended key usage %d is not valid for a TLS server certificate", usage)
+		}
+		if !seen[usage] {
+			seen[usage] = true
+			oids = append(oids, oid)
+		}
+	}
+	if !seen[x509.ExtKeyUsageServerAuth] {
+		return pkix.Extension{}, errors.New("ExtKeyUsage must include x509.ExtKeyUsageServerAuth")
+	}
+
+	value, err := asn1.Marshal(oids)
+	if err != nil {
+		return pkix.Extension{}, errors.Wrap(err, "failed to encode extended key usage")
+	}
+	return pkix.Extension{Id: extKeyUsageOID, Value: value}, nil
+}
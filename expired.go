@@ -0,0 +1,77 @@
+package tlslistener
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"time"
+)
+
+// expiredNotifyInterval rate-limits OnServingExpired per domain
+const expiredNotifyInterval = time.Minute
+
+// servingExpiredWindow is how long after serving an expired certificate
+// Status keeps reporting ServingExpired
+const servingExpiredWindow = 10 * time.Minute
+
+// checkServedExpiry reports a handshake served with an expired certificate
+// to Config.OnServingExpired, at most once per expiredNotifyInterval per
+// domain. autocert never serves expired certificates, but a static
+// Certificate, InternalCertificate or FallbackGetCertificate may.
+func (tl *TLSListener) checkServedExpiry(serverName string, cert *tls.Certificate) {
+	leaf := cert.Leaf
+	if leaf == nil {
+		if len(cert.Certificate) == 0 {
+			return
+		}
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return
+		}
+	}
+	now := tl.now()
+	if !now.After(leaf.NotAfter) {
+		return
+	}
+
+	domain := normalizeDomain(serverName)
+	tl.mu.Lock()
+	tl.lastExpiredServed = now
+	last, notified := tl.expiredNotified[domain]
+	notify := !notified || now.Sub(last) >= expiredNotifyInterval
+	if notify {
+		tl.expiredNotified[domain] = now
+	}
+	tl.mu.Unlock()
+
+	if !notify {
+		return
+	}
+	expiredSince := now.Sub(leaf.NotAfter)
+	tl.logf("WARNING: serving certificate for %q that expired %v ago", serverName, expiredSince.Round(time.Second))
+	if tl.onServingExpired != nil {
+		tl.onServingExpired(domain, expiredSince)
+	}
+}
+
+// servingExpired reports whether an expired certificate was served within
+// servingExpiredWindow
+func (tl *TLSListener) servingExpired() bool {
+	tl.mu.RLock()
+	defer tl.mu.RUnlock()
+	return !tl.lastExpiredServed.IsZero() && tl.now().Sub(tl.lastExpiredServed) < servingExpiredWindow
+}
+
+// withLeaf returns a copy of cert with its Leaf parsed, so per-handshake
+// checks need not parse it again, or cert itself if that is not possible
+func withLeaf(cert *tls.Certificate) *tls.Certificate {
+	if cert == nil || cert.Leaf != nil || len(cert.Certificate) == 0 {
+		return cert
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return cert
+	}
+	c := *cert
+	c.Leaf = leaf
+	return &c
+}
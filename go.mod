@@ -5,9 +5,7 @@ go 1.21.3
 require (
 	github.com/pkg/errors v0.9.1
 	golang.org/x/crypto v0.31.0
+	golang.org/x/net v0.21.0
 )
 
-require (
-	golang.org/x/net v0.21.0 // indirect
-	golang.org/x/text v0.21.0 // indirect
-)
+require golang.org/x/text v0.21.0 // indirect
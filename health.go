@@ -0,0 +1,66 @@
+package tlslistener
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Healthy returns nil if the listener is open and, when
+// MinRemainingValidity is set, the primary certificate has at least that
+// much validity left. On a shortfall it starts a forced renewal in the
+// background and reports the problem, so the instance can be taken out of
+// rotation until the renewal lands. A static Certificate cannot be renewed
+// here, so its shortfall is only reported.
+func (tl *TLSListener) Healthy() error {
+	if tl.isClosed() {
+		return ErrListenerClosed
+	}
+	if tl.minValidity <= 0 {
+		return nil
+	}
+
+	err := tl.checkValidity()
+	if err != nil && !tl.readOnly && tl.staticCert == nil && tl.healthRenewing.CompareAndSwap(false, true) {
+		go func() {
+			defer tl.healthRenewing.Store(false)
+			if err := tl.renewCertificates(tl.domain); err != nil {
+				tl.logf("Failed to renew certificate for %s: %v", tl.domain, err)
+				tl.renewError(tl.domain, err)
+				return
+			}
+			tl.recordRenewal(tl.domain)
+		}()
+	}
+	return err
+}
+
+// ensureValidity makes sure the primary certificate meets
+// MinRemainingValidity at startup, forcing a renewal if it does not
+func (tl *TLSListener) ensureValidity() error {
+	err := tl.checkValidity()
+	if err == nil || tl.readOnly || tl.staticCert != nil {
+		return err
+	}
+
+	tl.logf("%v; renewing before serving", err)
+	if err := tl.renewCertificates(tl.domain); err != nil {
+		return errors.Wrapf(err, "failed to renew certificate for %s", tl.domain)
+	}
+	tl.recordRenewal(tl.domain)
+	return tl.checkValidity()
+}
+
+// checkValidity returns an error if the primary certificate has less than
+// MinRemainingValidity left
+func (tl *TLSListener) checkValidity() error {
+	leaf, err := tl.LeafCertificate(tl.domain)
+	if err != nil {
+		return err
+	}
+	if remaining := leaf.NotAfter.Sub(tl.now()); remaining < tl.minValidity {
+		return errors.Errorf("certificate for %s expires in %v, less than the required %v",
+			tl.domain, remaining.Round(time.Minute), tl.minValidity)
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package tlslistener
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthyDoesNotRenewStaticCertificate(t *testing.T) {
+	var renewErrors atomic.Int32
+	tl := newTestListener(t, Config{
+		Certificate:          testCert(t, testDomain),
+		MinRemainingValidity: 24 * time.Hour,
+		OnRenewError:         func(string, error) { renewErrors.Add(1) },
+	})
+
+	// Move the clock to a day before the certificate expires
+	tl.nowFunc = func() time.Time { return time.Now().Add(89 * 24 * time.Hour) }
+	if err := tl.Healthy(); err == nil {
+		t.Fatal("Healthy passed a static certificate inside MinRemainingValidity")
+	}
+	if tl.healthRenewing.Load() {
+		t.Fatal("Healthy started a renewal of a static certificate")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := renewErrors.Load(); n != 0 {
+		t.Fatalf("%d renewal errors reported for a static certificate", n)
+	}
+}
@@ -0,0 +1,150 @@
+package tlslistener
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testDomain is the primary domain of test listeners
+const testDomain = "example.com"
+
+// unreachableCA is the ACME directory test listeners order from by default
+const unreachableCA = "https://127.0.0.1:1/directory"
+
+// newECDSAKey returns a fresh P-256 key
+func newECDSAKey(t *testing.T) crypto.Signer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// newRSAKey returns a fresh 2048-bit RSA key
+func newRSAKey(t *testing.T) crypto.Signer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// testCertPEM returns a self-signed certificate for hosts, valid from
+// notBefore to notAfter, and its key, both PEM-encoded
+func testCertPEM(t *testing.T, key crypto.Signer, notBefore, notAfter time.Time, hosts ...string) (certPEM, keyPEM []byte) {
+	t.Helper()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		DNSNames:     hosts,
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM
+}
+
+// testCert returns a tls.Certificate for hosts valid for the next 90 days
+func testCert(t *testing.T, hosts ...string) *tls.Certificate {
+	t.Helper()
+	certPEM, keyPEM := testCertPEM(t, newECDSAKey(t), time.Now().Add(-time.Hour), time.Now().Add(90*24*time.Hour), hosts...)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &cert
+}
+
+// newTestListener creates a listener on a loopback port with a temporary
+// CertDir, filling in whatever cfg leaves unset, and closes it when the test
+// ends
+func newTestListener(t *testing.T, cfg Config) *TLSListener {
+	t.Helper()
+	if cfg.Domain == "" {
+		cfg.Domain = testDomain
+	}
+	if cfg.CertDir == "" && cfg.Cache == nil {
+		cfg.CertDir = t.TempDir()
+	}
+	if cfg.Email == "" {
+		cfg.Email = "admin@" + testDomain
+	}
+	if cfg.DirectoryURL == "" {
+		// Nothing listens there, so tests never reach a real CA
+		cfg.DirectoryURL = unreachableCA
+	}
+	if cfg.ListenAddr == "" && cfg.BaseListener == nil {
+		cfg.ListenAddr = "127.0.0.1:0"
+	}
+	tl, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { tl.Close() })
+	return tl
+}
+
+// serveHandshakes accepts connections from tl and completes their
+// handshakes until tl is closed
+func serveHandshakes(tl *TLSListener) {
+	go func() {
+		for {
+			c, err := tl.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				if err := c.(*tls.Conn).Handshake(); err != nil {
+					return
+				}
+				c.Read(make([]byte, 1))
+			}()
+		}
+	}()
+}
+
+// dialTLS completes a handshake with tl as a client configured by cfg and
+// returns the certificate it was served
+func dialTLS(t *testing.T, tl *TLSListener, cfg *tls.Config) (*x509.Certificate, error) {
+	t.Helper()
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	c, err := tls.DialWithDialer(dialer, "tcp", tl.Addr().String(), cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.ConnectionState().PeerCertificates[0], nil
+}
+
+// rootsFor returns a pool trusting the PEM certificate certPEM
+func rootsFor(t *testing.T, certPEM []byte) *x509.CertPool {
+	t.Helper()
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(certPEM) {
+		t.Fatal("failed to add certificate to pool")
+	}
+	return pool
+}
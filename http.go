@@ -0,0 +1,111 @@
+package tlslistener
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// HTTPSRedirect redirects GET and HEAD requests to the same host and path
+// over HTTPS on the default port, and rejects other methods with 400 Bad
+// Request. The redirect is a 302 Found, which browsers do not cache, so
+// that plain HTTP can be served again later. It is the default fallback of
+// HTTPHandler.
+var HTTPSRedirect http.Handler = http.HandlerFunc(redirectHTTPS)
+
+func redirectHTTPS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Use HTTPS", http.StatusBadRequest)
+		return
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusFound)
+}
+
+// HTTPHandler returns a handler for the port 80 server that answers ACME
+// http-01 challenges and passes every other request to fallback. A nil
+// fallback redirects to HTTPS. Calling HTTPHandler also enables the http-01
+// challenge type, in addition to tls-alpn-01.
+func (tl *TLSListener) HTTPHandler(fallback http.Handler) http.Handler {
+	if fallback == nil {
+		fallback = HTTPSRedirect
+	}
+	tl.http01.Store(true)
+
+	tl.mu.RLock()
+	manager := tl.certManager
+	tl.mu.RUnlock()
+	manager.HTTPHandler(nil)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Resolve the manager per request, as it may be swapped at runtime
+		tl.mu.RLock()
+		manager := tl.certManager
+		tl.mu.RUnlock()
+
+		manager.HTTPHandler(fallback).ServeHTTP(w, r)
+	})
+}
+
+// ACMEChallengeHandler returns a handler that only answers ACME http-01
+// challenges and responds 404 Not Found to everything else. Mount it at
+// "/.well-known/acme-challenge/" in an existing mux when the rest of the
+// port 80 traffic is already handled elsewhere.
+func (tl *TLSListener) ACMEChallengeHandler() http.Handler {
+	return tl.HTTPHandler(http.NotFoundHandler())
+}
+
+// ServeHTTPChallenges listens on Config.HTTPChallengeAddr (":80" by
+// default), or serves Config.HTTPChallengeListener if set, and serves
+// HTTPHandler(fallback) there until Close is called, when it returns
+// http.ErrServerClosed. It blocks, so run it in its own goroutine.
+func (tl *TLSListener) ServeHTTPChallenges(fallback http.Handler) error {
+	addr := tl.httpChallengeAddr
+	if addr == "" {
+		addr = ":80"
+	}
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           tl.HTTPHandler(fallback),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	tl.mu.Lock()
+	if tl.listener == nil {
+		tl.mu.Unlock()
+		return ErrListenerClosed
+	}
+	tl.challengeServers = append(tl.challengeServers, server)
+	tl.mu.Unlock()
+
+	if tl.challengeListener != nil {
+		return server.Serve(tl.challengeListener)
+	}
+	return server.ListenAndServe()
+}
+
+// closeChallengeServers stops every server in servers
+func closeChallengeServers(servers []*http.Server) {
+	for _, server := range servers {
+		server.Close()
+	}
+}
+
+// validateListenAddr checks that addr is a usable host:port address
+func validateListenAddr(name, addr string) error {
+	if addr == "" {
+		return nil
+	}
+	if _, port, err := net.SplitHostPort(addr); err != nil {
+		return errors.Wrapf(err, "invalid %s %q", name, addr)
+	} else if _, err := net.LookupPort("tcp", port); err != nil {
+		return errors.Wrapf(err, "invalid %s %q", name, addr)
+	}
+	return nil
+}
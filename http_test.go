@@ -0,0 +1,24 @@
+package tlslistener
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPSRedirectIsTemporary(t *testing.T) {
+	rec := httptest.NewRecorder()
+	HTTPSRedirect.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com:80/path?q=1", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("status %d, want %d", rec.Code, http.StatusFound)
+	}
+	if got, want := rec.Header().Get("Location"), "https://example.com/path?q=1"; got != want {
+		t.Fatalf("Location %q, want %q", got, want)
+	}
+
+	rec = httptest.NewRecorder()
+	HTTPSRedirect.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "http://example.com/", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("POST answered %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,98 @@
+package tlslistener
+
+import (
+	"crypto/tls"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// KeyType selects the key algorithm of the certificates issued for a domain
+type KeyType int
+
+const (
+	// KeyTypeAuto lets autocert choose per client: ECDSA where the client
+	// supports it, RSA for legacy clients that do not
+	KeyTypeAuto KeyType = iota
+	// KeyTypeRSA serves an RSA certificate to every client
+	KeyTypeRSA
+	// KeyTypeECDSA serves an ECDSA P-256 certificate to every client, so
+	// clients without ECDSA support fail the handshake
+	KeyTypeECDSA
+)
+
+// String returns the name of the key type
+func (k KeyType) String() string {
+	switch k {
+	case KeyTypeAuto:
+		return "auto"
+	case KeyTypeRSA:
+		return "rsa"
+	case KeyTypeECDSA:
+		return "ecdsa"
+	}
+	return "unknown"
+}
+
+// normalizeKeyTypes validates DomainKeyType and returns a copy keyed by
+// normalized domain
+func normalizeKeyTypes(keyTypes map[string]KeyType) (map[string]KeyType, error) {
+	if len(keyTypes) == 0 {
+		return nil, nil
+	}
+	normalized := make(map[string]KeyType, len(keyTypes))
+	for domain, keyType := range keyTypes {
+		if keyType < KeyTypeAuto || keyType > KeyTypeECDSA {
+			return nil, errors.Errorf("invalid DomainKeyType %d for %q", keyType, domain)
+		}
+		normalized[normalizeDomain(domain)] = keyType
+	}
+	return normalized, nil
+}
+
+// keyTypeFor returns the key type configured for domain, matching a
+// "*.example.com" entry for names one label below it
+func (tl *TLSListener) keyTypeFor(domain string) KeyType {
+	if len(tl.domainKeyTypes) == 0 {
+		return KeyTypeAuto
+	}
+	domain = normalizeDomain(domain)
+	if keyType, ok := tl.domainKeyTypes[domain]; ok {
+		return keyType
+	}
+	if i := strings.IndexByte(domain, '.'); i > 0 {
+		return tl.domainKeyTypes["*"+domain[i:]]
+	}
+	return KeyTypeAuto
+}
+
+// cacheKey returns the cache key of the certificate renewal maintains for
+// domain: autocert stores RSA certificates under a "+rsa" suffix
+func (tl *TLSListener) cacheKey(domain string) string {
+	if tl.keyTypeFor(domain) == KeyTypeRSA {
+		return domain + "+rsa"
+	}
+	return domain
+}
+
+// keyTypeHello returns hello adjusted so that autocert, which picks the key
+// type from what the client advertises, issues and serves the key type
+// configured for its server name. The copy keeps the handshake context.
+func (tl *TLSListener) keyTypeHello(hello *tls.ClientHelloInfo) *tls.ClientHelloInfo {
+	keyType := tl.keyTypeFor(hello.ServerName)
+	if keyType == KeyTypeAuto {
+		return hello
+	}
+
+	adjusted := *hello
+	switch keyType {
+	case KeyTypeRSA:
+		// A signature_algorithms list without ECDSA rules it out
+		adjusted.SignatureSchemes = []tls.SignatureScheme{tls.PKCS1WithSHA256}
+	case KeyTypeECDSA:
+		adjusted.SignatureSchemes = []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256}
+		adjusted.SupportedCurves = []tls.CurveID{tls.CurveP256}
+		adjusted.CipherSuites = []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+	}
+	return &adjusted
+}
@@ -0,0 +1,196 @@
+package tlslistener
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// leaseKeyPrefix prefixes the cache keys holding renewal leases
+const leaseKeyPrefix = "renewal-lease+"
+
+// renewalLease is the cache entry recording which instance is renewing a
+// domain, and until when
+type renewalLease struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+// newLeaseOwner returns an identifier for this listener that is unique
+// across the instances sharing a cache
+func newLeaseOwner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+}
+
+// renewalLease takes domain's renewal lease, returning a function that
+// releases it. It returns nil, nil if another instance holds the lease, in
+// which case this instance skips the renewal and later picks up the result
+// from the shared cache.
+func (tl *TLSListener) renewalLease(domain string) (func(), error) {
+	tl.mu.RLock()
+	manager := tl.certManager
+	tl.mu.RUnlock()
+
+	if manager == nil {
+		return nil, errors.New("cert manager is not initialized")
+	}
+
+	ctx := context.Background()
+	acquired, holder, err := tl.acquireRenewalLease(ctx, manager.Cache, domain)
+	if err != nil {
+		return nil, err
+	}
+	if !acquired {
+		tl.logf("Skipping renewal of %s: renewal lease is held by %s", domain, holder)
+		return nil, nil
+	}
+	return func() { tl.releaseRenewalLease(ctx, manager.Cache, domain) }, nil
+}
+
+// acquireRenewalLease tries to take the renewal lease for domain in the
+// shared cache. It reports false, with the current holder, if another
+// instance holds an unexpired lease. autocert.Cache has no compare-and-swap,
+// so the lease is written and then read back; this serialises instances
+// whose checks do not run at the very same moment.
+func (tl *TLSListener) acquireRenewalLease(ctx context.Context, cache autocert.Cache, domain string) (bool, string, error) {
+	key := leaseKeyPrefix + domain
+	now := tl.now()
+
+	if current, err := readLease(ctx, cache, key); err != nil {
+		return false, "", err
+	} else if current != nil && current.Owner != tl.leaseOwner && now.Before(current.Expires) {
+		return false, current.Owner, nil
+	}
+
+	data, err := json.Marshal(renewalLease{Owner: tl.leaseOwner, Expires: now.Add(tl.renewalLeaseTTL)})
+	if err != nil {
+		return false, "", errors.Wrap(err, "failed to encode renewal lease")
+	}
+	if err := cache.Put(ctx, key, data); err != nil {
+		return false, "", errors.Wrapf(err, "failed to store renewal lease for %s", domain)
+	}
+
+	current, err := readLease(ctx, cache, key)
+	if err != nil {
+		return false, "", err
+	}
+	if current == nil || current.Owner != tl.leaseOwner {
+		holder := ""
+		if current != nil {
+			holder = current.Owner
+		}
+		return false, holder, nil
+	}
+	return true, tl.leaseOwner, nil
+}
+
+// releaseRenewalLease gives up domain's lease if this listener still holds it
+func (tl *TLSListener) releaseRenewalLease(ctx context.Context, cache autocert.Cache, domain string) {
+	key := leaseKeyPrefix + domain
+	current, err := readLease(ctx, cache, key)
+	if err != nil || current == nil || current.Owner != tl.leaseOwner {
+		return
+	}
+	if err := cache.Delete(ctx, key); err != nil {
+		tl.logf("Failed to release renewal lease for %s: %v", domain, err)
+	}
+}
+
+// readLease loads the lease stored under key, returning nil if there is none
+func readLease(ctx context.Context, cache autocert.Cache, key string) (*renewalLease, error) {
+	data, err := cache.Get(ctx, key)
+	if err == autocert.ErrCacheMiss {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read renewal lease %q", key)
+	}
+
+	var lease renewalLease
+	if err := json.Unmarshal(data, &lease); err != nil {
+		// A corrupt lease protects nothing; treat it as absent
+		return nil, nil
+	}
+	return &lease, nil
+}
+
+// reloadRenewedCert swaps in a fresh manager if the shared cache holds a
+// newer certificate for domain than the one being served, which is how
+// instances that lost the lease pick up the renewed certificate. autocert
+// keeps certificates in memory and would otherwise not look again until
+// its own renewal window.
+func (tl *TLSListener) reloadRenewedCert(domain string) {
+	tl.mu.RLock()
+	manager := tl.certManager
+	certDir := tl.certDir
+	tl.mu.RUnlock()
+
+	if manager == nil {
+		return
+	}
+
+	cached, err := cachedLeaf(context.Background(), manager.Cache, domain)
+	if err != nil {
+		return
+	}
+	served, err := tl.leafCertificate(manager, domain)
+	if err != nil || !cached.NotBefore.After(served.NotBefore) {
+		return
+	}
+
+	tl.refreshManager(certDir)
+	tl.logf("Loaded certificate for %s renewed by another instance", domain)
+}
+
+// setManager makes manager the current one; tl.mu must be held
+func (tl *TLSListener) setManager(manager *autocert.Manager) {
+	tl.certManager = manager
+	tl.managerSnap.Store(manager)
+}
+
+// refreshManager swaps in a new manager backed by certDir, so handshakes
+// reload certificates from the cache. The manager is left alone if the cache
+// moved in the meantime.
+func (tl *TLSListener) refreshManager(certDir string) {
+	fresh := tl.newManager(certDir)
+	tl.mu.Lock()
+	if tl.certDir == certDir {
+		tl.setManager(fresh)
+	}
+	tl.mu.Unlock()
+}
+
+// cachedLeaf parses the leaf certificate stored in cache under key, without
+// the validation autocert applies when loading it
+func cachedLeaf(ctx context.Context, cache autocert.Cache, key string) (*x509.Certificate, error) {
+	data, err := cache.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.Errorf("no certificate in cache entry %q", key)
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package tlslistener
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspTimeout bounds one OCSP request
+const ocspTimeout = 30 * time.Second
+
+// ocspRetryInterval is how soon a failed OCSP fetch is retried when the
+// configured interval is longer
+const ocspRetryInterval = 5 * time.Minute
+
+// maxOCSPResponseSize caps the OCSP response body read from the responder
+const maxOCSPResponseSize = 1 << 20
+
+// staticCertificate returns the static certificate with its latest OCSP
+// staple
+func (tl *TLSListener) staticCertificate() *tls.Certificate {
+	return tl.servedStatic.Load()
+}
+
+// ocspRoutine keeps the static certificate's OCSP staple fresh, refetching
+// it every OCSPUpdateInterval until the listener is closed
+func (tl *TLSListener) ocspRoutine() {
+	for {
+		wait := tl.ocspInterval
+		if err := tl.updateStaple(); err != nil {
+			tl.logf("Failed to update OCSP staple for %s: %v", tl.domain, err)
+			if wait > ocspRetryInterval {
+				wait = ocspRetryInterval
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-tl.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// updateStaple fetches a fresh OCSP response for the static certificate and
+// swaps in a copy of the certificate stapling it
+func (tl *TLSListener) updateStaple() error {
+	cert := tl.staticCert
+	if len(cert.Certificate) < 2 {
+		return errors.New("certificate chain has no issuer")
+	}
+	leaf, err := staticLeaf(cert)
+	if err != nil {
+		return err
+	}
+	if len(leaf.OCSPServer) == 0 {
+		return errors.New("certificate names no OCSP responder")
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return errors.Wrap(err, "failed to parse issuer certificate")
+	}
+
+	staple, resp, err := fetchOCSP(leaf, issuer, http.DefaultClient)
+	if err != nil {
+		return err
+	}
+	if resp.Status != ocsp.Good {
+		// Stapling a revoked status would only make clients fail sooner
+		return errors.Errorf("OCSP responder reports status %d for serial %s", resp.Status, leaf.SerialNumber)
+	}
+
+	stapled := *cert
+	stapled.OCSPStaple = staple
+	tl.servedStatic.Store(&stapled)
+	return nil
+}
+
+// fetchOCSP queries leaf's OCSP responder, returning the raw response and
+// its parsed form
+func fetchOCSP(leaf, issuer *x509.Certificate, client *http.Client) ([]byte, *ocsp.Response, error) {
+	reqBody, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to create OCSP request")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ocspTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, leaf.OCSPServer[0], bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+
+	httpResp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "OCSP request failed")
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, nil, errors.Errorf("unexpected status %s from %s", httpResp.Status, leaf.OCSPServer[0])
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(httpResp.Body, maxOCSPResponseSize))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to read OCSP response")
+	}
+	resp, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to parse OCSP response")
+	}
+	return raw, resp, nil
+}
@@ -0,0 +1,204 @@
+package tlslistener
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// proxyHeaderTimeout bounds how long a client may take to send its PROXY
+// protocol header
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyV2Signature starts every PROXY protocol version 2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyHeader reads the connection's PROXY protocol header, once. It runs
+// before the connection is handed to the caller, so the read deadline it
+// sets and then clears is the only one the connection has had.
+func (c *conn) proxyHeader() error {
+	c.proxyOnce.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.proxyAddr, c.proxyErr = readProxyHeader(c.br)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.proxyErr != nil {
+			c.proxyErr = errors.Wrap(c.proxyErr, "invalid PROXY protocol header")
+		}
+		c.proxyRead.Store(true)
+	})
+	return c.proxyErr
+}
+
+// proxyQueue hands out connections from accept once their PROXY protocol
+// header has been read, so RemoteAddr already reports the client when, for
+// example, http.Server records it ahead of the handshake. Each header is
+// read in its own goroutine, so a slow client never holds up the others.
+type proxyQueue struct {
+	accept func() (*tls.Conn, error)
+	stop   <-chan struct{}
+
+	once  sync.Once
+	ready chan acceptResult
+	done  chan struct{}
+}
+
+func newProxyQueue(accept func() (*tls.Conn, error), stop <-chan struct{}) *proxyQueue {
+	return &proxyQueue{
+		accept: accept,
+		stop:   stop,
+		ready:  make(chan acceptResult),
+		done:   make(chan struct{}),
+	}
+}
+
+// next returns the next connection whose header has been read
+func (q *proxyQueue) next() (*tls.Conn, error) {
+	q.once.Do(func() {
+		go q.run()
+	})
+
+	select {
+	case r := <-q.ready:
+		if r.err != nil {
+			return nil, r.err
+		}
+		return r.conn.(*tls.Conn), nil
+	case <-q.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+// run accepts connections until the listener is closed
+func (q *proxyQueue) run() {
+	defer close(q.done)
+
+	for {
+		tc, err := q.accept()
+		if err == ErrListenerClosed {
+			return
+		}
+		if err != nil {
+			// Hand the error to Accept, which lets net/http back off
+			select {
+			case q.ready <- acceptResult{err: err}:
+			case <-q.stop:
+				return
+			}
+			continue
+		}
+		go q.readHeader(tc)
+	}
+}
+
+// readHeader reads tc's PROXY protocol header and queues it for next, or
+// drops it if the header is missing or invalid
+func (q *proxyQueue) readHeader(tc *tls.Conn) {
+	if c, ok := tc.NetConn().(*conn); ok {
+		if err := c.proxyHeader(); err != nil {
+			tc.Close()
+			return
+		}
+	}
+
+	select {
+	case q.ready <- acceptResult{conn: tc}:
+	case <-q.done:
+		tc.Close()
+	}
+}
+
+// readProxyHeader consumes a PROXY protocol v1 or v2 header from br and
+// returns the client address it declares, or nil for a LOCAL/UNKNOWN
+// connection, such as a health check from the proxy itself
+func readProxyHeader(br *bufio.Reader) (net.Addr, error) {
+	sig, err := br.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(br)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyV1(br)
+	}
+	return nil, errors.New("missing PROXY protocol header")
+}
+
+// readProxyV1 parses a text header such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+func readProxyV1(br *bufio.Reader) (net.Addr, error) {
+	// A v1 header is at most 107 bytes including the CRLF
+	var line []byte
+	for len(line) < 107 {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("v1 header is not terminated")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.Errorf("malformed v1 header %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errors.Errorf("malformed v1 source address %s:%s", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 parses a binary header
+func readProxyV2(br *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, errors.Errorf("unsupported v2 version %d", header[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, err
+	}
+
+	// LOCAL connections carry no client address
+	if header[12]&0x0f == 0 {
+		return nil, nil
+	}
+
+	switch header[13] >> 4 {
+	case 1: // AF_INET
+		if len(body) < 12 {
+			return nil, errors.New("short v2 IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return nil, errors.New("short v2 IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	default:
+		// AF_UNSPEC and AF_UNIX say nothing useful about the client
+		return nil, nil
+	}
+}
@@ -0,0 +1,113 @@
+package tlslistener
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// proxyClient dials tl, sends header and returns an HTTPS client speaking
+// over that connection
+func proxyClient(t *testing.T, tl *TLSListener, header string, roots *x509.CertPool) *http.Client {
+	t.Helper()
+	return &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialTLSContext: func(_ context.Context, network, addr string) (net.Conn, error) {
+				c, err := net.Dial("tcp", tl.Addr().String())
+				if err != nil {
+					return nil, err
+				}
+				if _, err := io.WriteString(c, header); err != nil {
+					c.Close()
+					return nil, err
+				}
+				tc := tls.Client(c, &tls.Config{ServerName: testDomain, RootCAs: roots})
+				if err := tc.Handshake(); err != nil {
+					c.Close()
+					return nil, err
+				}
+				return tc, nil
+			},
+		},
+	}
+}
+
+func TestProxyProtocolRemoteAddrReachesHandler(t *testing.T) {
+	cert := testCert(t, testDomain)
+	tl := newTestListener(t, Config{Certificate: cert, ProxyProtocol: true})
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.RemoteAddr)
+	})}
+	go server.Serve(tl)
+	defer server.Close()
+
+	tests := []struct {
+		name, header, want string
+	}{
+		{"v1", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1:56324"},
+		{"v1 IPv6", "PROXY TCP6 2001:db8::1 2001:db8::2 40000 443\r\n", "[2001:db8::1]:40000"},
+		{"v2", string(proxyV2Signature) + "\x21\x11\x00\x0c" +
+			"\xc0\x00\x02\x07" + "\xc6\x33\x64\x01" + "\x1f\x90" + "\x01\xbb", "192.0.2.7:8080"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := proxyClient(t, tl, tt.header, roots).Get("https://" + testDomain + "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != tt.want {
+				t.Fatalf("handler saw RemoteAddr %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolSlowClientDoesNotBlockAccept(t *testing.T) {
+	tl := newTestListener(t, Config{Certificate: testCert(t, testDomain), ProxyProtocol: true})
+
+	// A client that never sends its header
+	silent, err := net.Dial("tcp", tl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := tl.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+
+	c, err := net.Dial("tcp", tl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n")
+
+	select {
+	case got := <-accepted:
+		defer got.Close()
+		// RemoteAddr must not wait on anything by now
+		if addr := got.RemoteAddr().String(); addr != "192.0.2.1:56324" {
+			t.Fatalf("RemoteAddr = %s, want the declared client", addr)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("a client without a header held up Accept")
+	}
+}
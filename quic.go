@@ -0,0 +1,35 @@
+package tlslistener
+
+import "crypto/tls"
+
+// QUICTLSConfig returns a TLS config for serving HTTP/3 over QUIC with the
+// same managed certificates as the TCP listener. QUIC requires TLS 1.3 and
+// carries no tls-alpn-01 challenges, so only "h3" is offered, including by
+// any config chosen per hello. Running the UDP listener is up to the
+// caller.
+func (tl *TLSListener) QUICTLSConfig() *tls.Config {
+	tl.mu.RLock()
+	tlsConfig := tl.tlsConfig
+	tl.mu.RUnlock()
+
+	quicConfig := tlsConfig.Clone()
+	forQUIC(quicConfig)
+	quicConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		cfg, err := tl.getConfigForClient(hello)
+		if err != nil || cfg == nil {
+			return cfg, err
+		}
+		// A replacement config would otherwise bring back its own versions
+		// and protocols
+		cfg = cfg.Clone()
+		forQUIC(cfg)
+		return cfg, nil
+	}
+	return quicConfig
+}
+
+// forQUIC restricts cfg to what HTTP/3 over QUIC negotiates
+func forQUIC(cfg *tls.Config) {
+	cfg.MinVersion = tls.VersionTLS13
+	cfg.NextProtos = []string{"h3"}
+}
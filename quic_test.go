@@ -0,0 +1,40 @@
+package tlslistener
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestQUICConfigPerHelloKeepsH3(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{"DisableSessionTickets", Config{DisableSessionTickets: true}},
+		{"GetConfigForClient", Config{GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return &tls.Config{NextProtos: []string{"http/1.1"}}, nil
+		}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Certificate = testCert(t, testDomain)
+			tl := newTestListener(t, tt.cfg)
+			quic := tl.QUICTLSConfig()
+
+			hello := &tls.ClientHelloInfo{ServerName: testDomain, SupportedVersions: []uint16{tls.VersionTLS12}}
+			cfg, err := quic.GetConfigForClient(hello)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg == nil {
+				t.Fatal("expected a per-hello config")
+			}
+			if cfg.MinVersion != tls.VersionTLS13 {
+				t.Errorf("MinVersion = %x, want TLS 1.3", cfg.MinVersion)
+			}
+			if len(cfg.NextProtos) != 1 || cfg.NextProtos[0] != "h3" {
+				t.Errorf("NextProtos = %q, want [h3]", cfg.NextProtos)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package tlslistener
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme"
+)
+
+// defaultRateLimitBackoff is assumed when a rate-limit response carries no
+// usable Retry-After header
+const defaultRateLimitBackoff = time.Hour
+
+// RateLimited reports whether the ACME server has rate-limited us and, if
+// so, when renewal will be attempted again. The renewal routine skips
+// renewals until then.
+func (tl *TLSListener) RateLimited() (bool, time.Time) {
+	tl.mu.RLock()
+	until := tl.rateLimitedUntil
+	tl.mu.RUnlock()
+
+	if tl.now().Before(until) {
+		return true, until
+	}
+	return false, time.Time{}
+}
+
+// noteRateLimit starts backing off if err is an ACME rate-limit error
+func (tl *TLSListener) noteRateLimit(domain string, err error) {
+	var acmeErr *acme.Error
+	if !errors.As(err, &acmeErr) || !isRateLimit(acmeErr) {
+		return
+	}
+
+	backoff := defaultRateLimitBackoff
+	if acmeErr.Header != nil {
+		if d := parseRetryAfter(acmeErr.Header.Get("Retry-After"), tl.now()); d > 0 {
+			backoff = d
+		}
+	}
+	until := tl.now().Add(backoff)
+
+	tl.mu.Lock()
+	tl.rateLimitedUntil = until
+	tl.mu.Unlock()
+
+	tl.logf("WARNING: ACME server rate-limited renewal of %s; backing off until %v", domain, until)
+}
+
+// isRateLimit reports whether err is the ACME server refusing us for
+// exceeding a rate limit
+func isRateLimit(err *acme.Error) bool {
+	return err.StatusCode == http.StatusTooManyRequests ||
+		err.ProblemType == "urn:ietf:params:acme:error:rateLimited"
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an
+// HTTP date, returning zero if it is missing or invalid
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return t.Sub(now)
+	}
+	return 0
+}
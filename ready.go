@@ -0,0 +1,51 @@
+package tlslistener
+
+import "crypto/tls"
+
+// Ready returns a channel that is closed once a valid certificate for the
+// primary domain is available, whether it was already cached at startup or
+// obtained on the first handshake or renewal, so dependent services can wait
+// until the listener can really serve TLS
+func (tl *TLSListener) Ready() <-chan struct{} {
+	return tl.ready
+}
+
+// markReady closes the Ready channel, once
+func (tl *TLSListener) markReady() {
+	tl.readyOnce.Do(func() { close(tl.ready) })
+}
+
+// isReady reports whether the Ready channel has been closed
+func (tl *TLSListener) isReady() bool {
+	select {
+	case <-tl.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// checkReady marks the listener ready if the primary domain's certificate
+// is static or cached and has not expired. It never orders a certificate.
+func (tl *TLSListener) checkReady() {
+	if tl.isReady() || (tl.staticCert == nil && !tl.HasCachedCert(tl.domain)) {
+		return
+	}
+	if leaf, err := tl.LeafCertificate(tl.domain); err == nil && !tl.now().After(leaf.NotAfter) {
+		tl.markReady()
+	}
+}
+
+// servedReady marks the listener ready when cert, just served for
+// serverName, is a valid certificate for the primary domain. A stand-in
+// served under SNIErrorHandler does not cover it and is passed over.
+func (tl *TLSListener) servedReady(serverName string, cert *tls.Certificate) {
+	if tl.isReady() || normalizeDomain(serverName) != normalizeDomain(tl.domain) {
+		return
+	}
+	leaf, err := staticLeaf(cert)
+	if err != nil || tl.now().After(leaf.NotAfter) || leaf.VerifyHostname(tl.domain) != nil {
+		return
+	}
+	tl.markReady()
+}
@@ -0,0 +1,47 @@
+package tlslistener
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestReadyIgnoresSNIErrorCertificate(t *testing.T) {
+	tl := newTestListener(t, Config{SNIErrorHandler: http.NotFoundHandler()})
+	tl.DisableDomain(testDomain)
+	go func() {
+		for {
+			c, err := tl.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	// The disabled primary domain is served the self-signed stand-in
+	dialTLS(t, tl, &tls.Config{ServerName: testDomain, InsecureSkipVerify: true})
+
+	select {
+	case <-tl.Ready():
+		t.Fatal("Ready closed on the SNIErrorHandler certificate")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestReadyOnServedPrimaryCertificate(t *testing.T) {
+	tl := newTestListener(t, Config{})
+	certPEM, keyPEM := testCertPEM(t, newECDSAKey(t), time.Now().Add(-time.Hour), time.Now().Add(90*24*time.Hour), testDomain)
+	putCert(t, tl, testDomain, certPEM, keyPEM)
+	serveHandshakes(tl)
+
+	if _, err := dialTLS(t, tl, &tls.Config{ServerName: testDomain, RootCAs: rootsFor(t, certPEM)}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-tl.Ready():
+	case <-time.After(time.Second):
+		t.Fatal("Ready stayed open after the primary certificate was served")
+	}
+}
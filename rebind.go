@@ -0,0 +1,156 @@
+package tlslistener
+
+import (
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Rebind swaps in a new socket built from the socket settings of cfg
+// (BaseListener, KeepBaseListenerOpen, Network, ListenAddr, ControlFunc and
+// RebindGracePeriod) while the certificate manager, TLS config and renewal
+// carry on. Other fields of cfg are ignored. Connections already accepted
+// are unaffected. The old socket, if wileedot owns it, is closed
+// RebindGracePeriod after the new one is in place, which moves Accept calls
+// still blocked on it over to the new socket. Rebinding to an address the
+// old socket still holds closes it first, briefly refusing connections,
+// unless ControlFunc sets SO_REUSEPORT.
+func (tl *TLSListener) Rebind(cfg Config) error {
+	switch cfg.Network {
+	case "", "tcp", "tcp4", "tcp6":
+		if err := validateListenAddr("ListenAddr", cfg.ListenAddr); err != nil {
+			return err
+		}
+	case "unix":
+		if cfg.BaseListener == nil && tl.staticCert == nil {
+			return errors.New("a unix socket cannot answer ACME challenges; Certificate is required")
+		}
+	default:
+		return errors.Errorf("unsupported network %q", cfg.Network)
+	}
+	if cfg.BaseListener != nil {
+		if err := tl.validateBaseListener(cfg.BaseListener); err != nil {
+			return err
+		}
+	}
+
+	tl.rebindMu.Lock()
+	defer tl.rebindMu.Unlock()
+
+	tl.mu.RLock()
+	old := tl.listener
+	closed := old == nil || tl.draining
+	oldOwned := tl.ownsListener || tl.ownsBase
+	// Only a socket wileedot created itself can be recreated if rebinding
+	// fails after closing it
+	oldCreated := tl.ownsListener
+	tl.mu.RUnlock()
+	if closed {
+		return ErrListenerClosed
+	}
+
+	spec := socketSpec{network: cfg.Network, addr: cfg.ListenAddr, control: cfg.ControlFunc}
+	ln := cfg.BaseListener
+	if ln == nil {
+		// The socket file can only be bound once
+		sameFile := oldCreated && spec.network == "unix" && old.Addr().String() == spec.addr
+
+		var err error
+		if !sameFile {
+			// Bind outside the lock, which every Accept and Close also take
+			ln, err = tl.listen(spec)
+		}
+		if oldCreated && (sameFile || errors.Is(err, syscall.EADDRINUSE)) {
+			return tl.rebindInPlace(old, spec, cfg.KeepBaseListenerOpen)
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to create new listener")
+		}
+	}
+
+	tl.mu.Lock()
+	if tl.listener != old || tl.draining {
+		// Closed while binding
+		tl.mu.Unlock()
+		if cfg.BaseListener == nil {
+			ln.Close()
+		}
+		return ErrListenerClosed
+	}
+	tl.listener = ln
+	tl.ownsListener = cfg.BaseListener == nil
+	tl.ownsBase = !cfg.KeepBaseListenerOpen
+	if cfg.BaseListener == nil {
+		tl.network, tl.listenAddr, tl.controlFunc = spec.network, spec.addr, spec.control
+	}
+	tl.mu.Unlock()
+
+	tl.logf("Rebound listener from %s to %s", old.Addr(), ln.Addr())
+	if oldOwned {
+		tl.closeAfter(old, cfg.RebindGracePeriod)
+	}
+	return nil
+}
+
+// rebindInPlace replaces old, a socket wileedot created, with one described
+// by spec that needs its address. The old socket has to go first, so the
+// lock is held from closing it to binding the new one: Accept calls that
+// see it close then find its replacement rather than a closed listener. If
+// the new socket cannot be bound, the old one is recreated.
+func (tl *TLSListener) rebindInPlace(old net.Listener, spec socketSpec, keepBaseOpen bool) error {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	if tl.listener != old || tl.draining {
+		return ErrListenerClosed
+	}
+
+	oldSpec := socketSpec{network: tl.network, addr: tl.listenAddr, control: tl.controlFunc}
+	old.Close()
+	ln, err := tl.listen(spec)
+	if err != nil {
+		// The old socket is gone, so try to restore it
+		restored, restoreErr := tl.listen(oldSpec)
+		if restoreErr != nil {
+			tl.listener = nil
+			return errors.Wrapf(err, "failed to create new listener, and the old one could not be restored (%v)", restoreErr)
+		}
+		tl.listener = restored
+		tl.ownsListener = true
+		return errors.Wrap(err, "failed to create new listener; the old one was restored")
+	}
+
+	tl.listener = ln
+	tl.ownsListener = true
+	tl.ownsBase = !keepBaseOpen
+	tl.network, tl.listenAddr, tl.controlFunc = spec.network, spec.addr, spec.control
+	tl.logf("Rebound listener from %s to %s", old.Addr(), ln.Addr())
+	return nil
+}
+
+// closeAfter closes a socket replaced by Rebind once grace has passed, or
+// as soon as the TLSListener is closed
+func (tl *TLSListener) closeAfter(old net.Listener, grace time.Duration) {
+	if grace <= 0 {
+		old.Close()
+		return
+	}
+	go func() {
+		timer := time.NewTimer(grace)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-tl.done:
+		}
+		old.Close()
+	}()
+}
+
+// rebound reports whether listener has been replaced by Rebind while the
+// TLSListener stays open
+func (tl *TLSListener) rebound(listener net.Listener) bool {
+	tl.mu.RLock()
+	defer tl.mu.RUnlock()
+	return tl.listener != nil && !tl.draining && tl.listener != listener
+}
@@ -0,0 +1,84 @@
+package tlslistener
+
+import (
+	"crypto/tls"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRebindClosesOldSocketAfterGrace(t *testing.T) {
+	tl := newTestListener(t, Config{Certificate: testCert(t, testDomain)})
+	oldAddr := tl.Addr().String()
+
+	if err := tl.Rebind(Config{ListenAddr: "127.0.0.1:0", RebindGracePeriod: 200 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	if tl.Addr().String() == oldAddr {
+		t.Fatal("Rebind kept the old address")
+	}
+
+	c, err := net.Dial("tcp", oldAddr)
+	if err != nil {
+		t.Fatalf("old socket closed within its grace period: %v", err)
+	}
+	c.Close()
+
+	waitFor(t, "the old socket to close", func() bool {
+		c, err := net.Dial("tcp", oldAddr)
+		if err == nil {
+			c.Close()
+		}
+		return err != nil
+	})
+}
+
+func TestRebindInPlace(t *testing.T) {
+	tl := newTestListener(t, Config{Certificate: testCert(t, testDomain)})
+	addr := tl.Addr().String()
+
+	if err := tl.Rebind(Config{ListenAddr: addr}); err != nil {
+		t.Fatal(err)
+	}
+	if got := tl.Addr().String(); got != addr {
+		t.Fatalf("rebound to %s, want %s", got, addr)
+	}
+	serveHandshakes(tl)
+	if _, err := dialTLS(t, tl, &tls.Config{ServerName: testDomain, InsecureSkipVerify: true}); err != nil {
+		t.Fatalf("handshake on the rebound socket: %v", err)
+	}
+}
+
+func TestRebindBindsOutsideLock(t *testing.T) {
+	tl := newTestListener(t, Config{Certificate: testCert(t, testDomain)})
+	binding := make(chan struct{})
+	release := make(chan struct{})
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- tl.Rebind(Config{
+			ListenAddr: "127.0.0.1:0",
+			ControlFunc: func(network, address string, c syscall.RawConn) error {
+				close(binding)
+				<-release
+				return nil
+			},
+		})
+	}()
+	<-binding
+
+	addr := make(chan net.Addr, 1)
+	go func() { addr <- tl.Addr() }()
+	select {
+	case <-addr:
+	case <-time.After(time.Second):
+		close(release)
+		t.Fatal("Rebind held the listener's lock while binding")
+	}
+
+	close(release)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
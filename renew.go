@@ -0,0 +1,233 @@
+package tlslistener
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// forceRenew orders a brand new certificate for domain. autocert would
+// otherwise keep serving the cached certificate until its own renewal
+// window, so issuance goes through a throwaway manager that cannot see the
+// cached entry. The new certificate is held back until it has been checked,
+// then written to the shared cache, and a fresh manager is swapped in so
+// handshakes load it from there. On any failure the current certificate
+// stays in place.
+func (tl *TLSListener) forceRenew(domain string) error {
+	if tl.readOnly {
+		return errors.Wrapf(errReadOnly, "cannot renew %s", domain)
+	}
+	if tl.staticCert != nil {
+		return errors.Errorf("cannot renew %s: a static Certificate is configured", domain)
+	}
+
+	if err := tl.approve(domain); err != nil {
+		return err
+	}
+
+	tl.mu.RLock()
+	certDir := tl.certDir
+	tl.mu.RUnlock()
+
+	data, ca, err := tl.issue(certDir, domain)
+	if err != nil {
+		return err
+	}
+	return tl.storeIssued(certDir, domain, data, ca)
+}
+
+// storeIssued checks a certificate issued for domain by the CA at ca and
+// writes it to the shared cache, then swaps in a fresh manager so
+// handshakes load it from there
+func (tl *TLSListener) storeIssued(certDir, domain string, data []byte, ca string) error {
+	if err := tl.verifyRenewed(domain, data); err != nil {
+		return errors.Wrapf(err, "new certificate for %s failed verification", domain)
+	}
+
+	tl.mu.RLock()
+	cache := tl.certManager.Cache
+	tl.mu.RUnlock()
+	if err := cache.Put(context.Background(), tl.cacheKey(domain), data); err != nil {
+		return errors.Wrapf(err, "failed to store new certificate for %s", domain)
+	}
+
+	tl.mu.Lock()
+	tl.issuingCA[normalizeDomain(domain)] = ca
+	tl.mu.Unlock()
+
+	tl.refreshManager(certDir)
+	return nil
+}
+
+// fallbackAfterFailures is how many consecutive failed orders from the
+// primary CA make issuance fail over to FallbackDirectoryURL
+const fallbackAfterFailures = 2
+
+// issue orders a certificate for domain from the primary CA, failing over
+// to the fallback CA, if one is configured, once the primary has failed
+// persistently or rate-limited us. It returns the certificate as it should
+// be cached, without storing it, along with the directory URL it came from.
+func (tl *TLSListener) issue(certDir, domain string) (data []byte, directoryURL string, err error) {
+	data, err = tl.issueFrom(certDir, domain, tl.directoryURL, nil)
+	if err == nil {
+		tl.primaryFailures.Store(0)
+		return data, tl.primaryDirectoryURL(), nil
+	}
+
+	failures := tl.primaryFailures.Add(1)
+	var acmeErr *acme.Error
+	limited := errors.As(err, &acmeErr) && isRateLimit(acmeErr)
+	if tl.fallbackDirectoryURL == "" || (failures < fallbackAfterFailures && !limited) {
+		return nil, "", err
+	}
+
+	tl.logf("WARNING: renewal of %s from %s failed (%v); trying fallback CA %s",
+		domain, tl.primaryDirectoryURL(), err, tl.fallbackDirectoryURL)
+	data, fbErr := tl.issueFrom(certDir, domain, tl.fallbackDirectoryURL, tl.fallbackEAB)
+	if fbErr != nil {
+		return nil, "", errors.Wrapf(fbErr, "fallback CA failed after primary CA error (%v)", err)
+	}
+	return data, tl.fallbackDirectoryURL, nil
+}
+
+// fallbackCertificate is called when on-demand issuance for hello from the
+// primary CA failed with primaryErr. Under the same rule as renewals, it
+// orders the certificate from the fallback CA instead and serves it; until
+// the rule is met, or while another handshake is already ordering the
+// domain from the fallback, primaryErr is returned.
+func (tl *TLSListener) fallbackCertificate(hello *tls.ClientHelloInfo, primaryErr error) (*tls.Certificate, error) {
+	domain := normalizeDomain(hello.ServerName)
+	if tl.fallbackDirectoryURL == "" || tl.readOnly || isChallengeHello(hello) ||
+		tl.hostRejected(helloContext(hello), domain) != nil {
+		return nil, primaryErr
+	}
+
+	failures := tl.primaryFailures.Add(1)
+	var acmeErr *acme.Error
+	limited := errors.As(primaryErr, &acmeErr) && isRateLimit(acmeErr)
+	if failures < fallbackAfterFailures && !limited {
+		return nil, primaryErr
+	}
+	if _, busy := tl.fallbackOrders.LoadOrStore(domain, true); busy {
+		return nil, primaryErr
+	}
+	defer tl.fallbackOrders.Delete(domain)
+
+	tl.logf("WARNING: issuance of %s from %s failed (%v); trying fallback CA %s",
+		domain, tl.primaryDirectoryURL(), primaryErr, tl.fallbackDirectoryURL)
+	tl.mu.RLock()
+	certDir := tl.certDir
+	tl.mu.RUnlock()
+	data, err := tl.issueFrom(certDir, domain, tl.fallbackDirectoryURL, tl.fallbackEAB)
+	if err == nil {
+		err = tl.storeIssued(certDir, domain, data, tl.fallbackDirectoryURL)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "fallback CA failed after primary CA error (%v)", primaryErr)
+	}
+	return tl.checkedCertificate(tl.managerSnap.Load(), hello)
+}
+
+// issueFrom orders a certificate for domain from the CA at directoryURL
+// through a throwaway manager whose writes to domain's entry are staged.
+// autocert arms a renewal timer on every certificate it issues, which
+// nothing can stop, so the manager is retired once issueFrom returns: its
+// timer then sees whatever the real cache holds and can no longer order.
+func (tl *TLSListener) issueFrom(certDir, domain, directoryURL string, eab *acme.ExternalAccountBinding) ([]byte, error) {
+	issuer := tl.newManagerForCA(certDir, directoryURL, eab)
+	issuer.HostPolicy = tl.renewalHostPolicy(issuer.Cache)
+	transport := &retiringTransport{base: issuer.Client.HTTPClient.Transport}
+	issuer.Client.HTTPClient = &http.Client{Transport: transport}
+	key := tl.cacheKey(domain)
+	staging := newStagingCache(issuer.Cache, key)
+	issuer.Cache = staging
+	defer func() {
+		transport.retire()
+		staging.retire()
+	}()
+	if _, err := tl.managerCertificate(issuer, helloFor(domain)); err != nil {
+		return nil, errors.Wrapf(err, "failed to obtain new certificate for %s", domain)
+	}
+
+	data := staging.result(key)
+	if data == nil {
+		return nil, errors.Errorf("new certificate for %s was not stored", domain)
+	}
+	return data, nil
+}
+
+// retiringTransport is an http.RoundTripper that passes requests on to base
+// until it is retired, and fails them from then on
+type retiringTransport struct {
+	base    http.RoundTripper
+	retired atomic.Bool
+}
+
+func (t *retiringTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.retired.Load() {
+		return nil, errors.Errorf("refusing ACME request to %s from a retired issuer", req.URL)
+	}
+	return t.base.RoundTrip(req)
+}
+
+func (t *retiringTransport) retire() {
+	t.retired.Store(true)
+}
+
+// primaryDirectoryURL returns the directory URL of the primary CA
+func (tl *TLSListener) primaryDirectoryURL() string {
+	if tl.directoryURL == "" {
+		return autocert.DefaultACMEDirectory
+	}
+	return tl.directoryURL
+}
+
+// verifyRenewed checks that data holds a usable certificate for domain
+func (tl *TLSListener) verifyRenewed(domain string, data []byte) error {
+	cert, err := parseCacheEntry(data)
+	if err != nil {
+		return err
+	}
+	if err := cert.Leaf.VerifyHostname(domain); err != nil {
+		return err
+	}
+	now := tl.now()
+	if now.Before(cert.Leaf.NotBefore) || now.After(cert.Leaf.NotAfter) {
+		return errors.Errorf("certificate is only valid from %v to %v", cert.Leaf.NotBefore, cert.Leaf.NotAfter)
+	}
+	return nil
+}
+
+// LastRenewalError returns the error from the most recent renewal attempt,
+// or nil if it succeeded or none has been made
+func (tl *TLSListener) LastRenewalError() error {
+	tl.mu.RLock()
+	defer tl.mu.RUnlock()
+	return tl.lastRenewalErr
+}
+
+// RenewIfOlderThan renews domain's certificate if it was issued more than
+// maxAge ago, and reports whether it did. It is idempotent, which suits
+// maintenance scripts: running it twice renews at most once.
+func (tl *TLSListener) RenewIfOlderThan(domain string, maxAge time.Duration) (renewed bool, err error) {
+	leaf, err := tl.LeafCertificate(domain)
+	if err != nil {
+		return false, err
+	}
+
+	if !leaf.NotBefore.Before(tl.now().Add(-maxAge)) {
+		return false, nil
+	}
+
+	if err := tl.renewCertificates(domain); err != nil {
+		return false, err
+	}
+	tl.recordRenewal(domain)
+	return true, nil
+}
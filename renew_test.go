@@ -0,0 +1,102 @@
+package tlslistener
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// roundTripFunc adapts a function to an http.RoundTripper
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestRetiredIssuerCannotOrder(t *testing.T) {
+	var sent int
+	transport := &retiringTransport{base: roundTripFunc(func(*http.Request) (*http.Response, error) {
+		sent++
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	})}
+	req, _ := http.NewRequest(http.MethodGet, unreachableCA, nil)
+	if _, err := transport.RoundTrip(req); err != nil || sent != 1 {
+		t.Fatalf("live issuer: err %v, %d requests sent", err, sent)
+	}
+	transport.retire()
+	if _, err := transport.RoundTrip(req); err == nil || sent != 1 {
+		t.Fatalf("retired issuer: err %v, %d requests sent", err, sent)
+	}
+}
+
+func TestRetiredStagingReadsSharedCache(t *testing.T) {
+	ctx := context.Background()
+	shared := newMemoryCache()
+	if err := shared.Put(ctx, testDomain, []byte("current")); err != nil {
+		t.Fatal(err)
+	}
+	staging := newStagingCache(shared, testDomain)
+	if err := staging.Put(ctx, testDomain, []byte("staged")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := shared.Get(ctx, testDomain); !bytes.Equal(data, []byte("current")) {
+		t.Fatal("a staged write reached the shared cache")
+	}
+
+	staging.retire()
+	data, err := staging.Get(ctx, testDomain)
+	if err != nil || !bytes.Equal(data, []byte("current")) {
+		t.Fatalf("retired staging read %q, %v; want the shared entry", data, err)
+	}
+}
+
+// failingCA returns the directory URL of an ACME server that refuses every
+// request, and a count of the requests it has received
+func failingCA(t *testing.T) (string, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	ca := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "refused", http.StatusBadRequest)
+	}))
+	t.Cleanup(ca.Close)
+	return ca.URL + "/directory", &requests
+}
+
+func TestForcedRenewalFailsOver(t *testing.T) {
+	primary, primaryRequests := failingCA(t)
+	fallback, fallbackRequests := failingCA(t)
+	tl := newTestListener(t, Config{DirectoryURL: primary, FallbackDirectoryURL: fallback})
+
+	if err := tl.forceRenew(testDomain); err == nil {
+		t.Fatal("renewal from a failing CA succeeded")
+	}
+	if primaryRequests.Load() == 0 || fallbackRequests.Load() != 0 {
+		t.Fatalf("first failure: %d primary, %d fallback requests", primaryRequests.Load(), fallbackRequests.Load())
+	}
+	tl.forceRenew(testDomain)
+	if fallbackRequests.Load() == 0 {
+		t.Fatal("repeated renewal failures did not fail over")
+	}
+}
+
+func TestOnDemandIssuanceFailsOver(t *testing.T) {
+	primary, primaryRequests := failingCA(t)
+	fallback, fallbackRequests := failingCA(t)
+	tl := newTestListener(t, Config{DirectoryURL: primary, FallbackDirectoryURL: fallback})
+	serveHandshakes(tl)
+
+	cfg := &tls.Config{ServerName: testDomain, InsecureSkipVerify: true}
+	if _, err := dialTLS(t, tl, cfg); err == nil {
+		t.Fatal("handshake without a certificate succeeded")
+	}
+	if primaryRequests.Load() == 0 || fallbackRequests.Load() != 0 {
+		t.Fatalf("first failure: %d primary, %d fallback requests", primaryRequests.Load(), fallbackRequests.Load())
+	}
+	dialTLS(t, tl, cfg)
+	if fallbackRequests.Load() == 0 {
+		t.Fatal("repeated issuance failures did not fail over")
+	}
+}
@@ -0,0 +1,61 @@
+package tlslistener
+
+import (
+	"encoding/asn1"
+
+	"github.com/pkg/errors"
+)
+
+// sctListOID identifies the embedded SCT list extension (RFC 6962)
+var sctListOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+
+// HasSCTs reports whether the certificate served for domain embeds Signed
+// Certificate Timestamps, and how many, for checking CT compliance
+func (tl *TLSListener) HasSCTs(domain string) (bool, int, error) {
+	leaf, err := tl.LeafCertificate(domain)
+	if err != nil {
+		return false, 0, err
+	}
+
+	for _, ext := range leaf.Extensions {
+		if !ext.Id.Equal(sctListOID) {
+			continue
+		}
+		n, err := countSCTs(ext.Value)
+		if err != nil {
+			return false, 0, errors.Wrap(err, "invalid SCT list extension")
+		}
+		return n > 0, n, nil
+	}
+	return false, 0, nil
+}
+
+// countSCTs counts the entries of a DER-wrapped SignedCertificateTimestampList,
+// a 16-bit length followed by 16-bit length-prefixed SCTs
+func countSCTs(value []byte) (int, error) {
+	var list []byte
+	if rest, err := asn1.Unmarshal(value, &list); err != nil {
+		return 0, err
+	} else if len(rest) > 0 {
+		return 0, errors.New("trailing data after SCT list")
+	}
+
+	if len(list) < 2 || int(list[0])<<8|int(list[1]) != len(list)-2 {
+		return 0, errors.New("bad SCT list length")
+	}
+	list = list[2:]
+
+	n := 0
+	for len(list) > 0 {
+		if len(list) < 2 {
+			return 0, errors.New("truncated SCT")
+		}
+		size := int(list[0])<<8 | int(list[1])
+		if size == 0 || len(list) < 2+size {
+			return 0, errors.New("truncated SCT")
+		}
+		list = list[2+size:]
+		n++
+	}
+	return n, nil
+}
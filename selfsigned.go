@@ -0,0 +1,108 @@
+package tlslistener
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// selfSignedValidity is the lifetime of generated self-signed certificates
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// selfSignedCert generates an ECDSA P-256 certificate for hosts, signed by
+// its own key. Hosts may be DNS names or IP addresses.
+func selfSignedCert(hosts []string, validity time.Duration) (*tls.Certificate, error) {
+	if len(hosts) == 0 {
+		return nil, errors.New("at least one host is required")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate key")
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate serial number")
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hosts[0], Organization: []string{"wileedot self-signed"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create certificate")
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse certificate")
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// selfSignedRenewWindow is how close to expiry a generated self-signed
+// certificate is regenerated
+const selfSignedRenewWindow = 30 * 24 * time.Hour
+
+// generatesSelfSigned reports whether the listener serves self-signed
+// certificates it generated itself, which it must also regenerate
+func (tl *TLSListener) generatesSelfSigned() bool {
+	return tl.internalHosts != nil || tl.sniErrorHandler != nil
+}
+
+// refreshSelfSigned regenerates the generated internal and SNI error
+// certificates once they are within selfSignedRenewWindow of expiry, so
+// long-running servers keep working without a restart
+func (tl *TLSListener) refreshSelfSigned() {
+	if tl.internalHosts != nil {
+		tl.regenerateSelfSigned(&tl.internalCert, tl.internalHosts, "internal")
+	}
+	if tl.sniErrorHandler != nil {
+		tl.regenerateSelfSigned(&tl.sniError.cert, []string{"localhost"}, "SNI error")
+	}
+}
+
+// regenerateSelfSigned replaces the certificate in cert with a new
+// self-signed certificate for hosts if it is due
+func (tl *TLSListener) regenerateSelfSigned(cert *atomic.Pointer[tls.Certificate], hosts []string, name string) {
+	if cert.Load().Leaf.NotAfter.Sub(tl.now()) > selfSignedRenewWindow {
+		return
+	}
+
+	fresh, err := selfSignedCert(hosts, selfSignedValidity)
+	if err != nil {
+		tl.logf("Failed to regenerate %s certificate: %v", name, err)
+		return
+	}
+	cert.Store(fresh)
+	tl.logf("Regenerated %s certificate, valid until %v", name, fresh.Leaf.NotAfter)
+}
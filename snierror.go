@@ -0,0 +1,195 @@
+package tlslistener
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// screenHandshakeTimeout bounds the handshakes Accept completes itself
+// when SNIErrorHandler is set
+const screenHandshakeTimeout = 10 * time.Second
+
+// acceptResult is a connection, or error, handed from screenConns to Accept
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// sniErrorState holds what SNIErrorHandler needs. With a handler set,
+// Accept completes each handshake before returning the connection, so that
+// those for domains we cannot serve can be diverted to the error server.
+type sniErrorState struct {
+	cert     atomic.Pointer[tls.Certificate]
+	server   *http.Server
+	listener *chanListener
+
+	screenOnce sync.Once
+	screened   chan acceptResult
+	screenDone chan struct{}
+}
+
+// startSNIErrorServer generates the fallback certificate and starts the
+// server that answers diverted connections with SNIErrorHandler
+func (tl *TLSListener) startSNIErrorServer() error {
+	cert, err := selfSignedCert([]string{"localhost"}, selfSignedValidity)
+	if err != nil {
+		return errors.Wrap(err, "failed to generate SNI error certificate")
+	}
+
+	tl.sniError.cert.Store(cert)
+	tl.sniError.listener = newChanListener()
+	tl.sniError.server = &http.Server{
+		Handler:           tl.sniErrorHandler,
+		ReadHeaderTimeout: screenHandshakeTimeout,
+	}
+	tl.sniError.screened = make(chan acceptResult)
+	tl.sniError.screenDone = make(chan struct{})
+	go tl.sniError.server.Serve(tl.sniError.listener)
+	return nil
+}
+
+// closeSNIErrorServer stops the error server and its connections
+func (tl *TLSListener) closeSNIErrorServer() {
+	if tl.sniError.server != nil {
+		tl.sniError.server.Close()
+	}
+}
+
+// sniErrorCertificate returns err, unless SNIErrorHandler is set and the
+// host policy rejects hello's name, in which case the connection is marked
+// for the error server and completes its handshake with the fallback
+// certificate
+func (tl *TLSListener) sniErrorCertificate(hello *tls.ClientHelloInfo, err error) (*tls.Certificate, error) {
+	if tl.sniErrorHandler == nil || isChallengeHello(hello) {
+		return nil, err
+	}
+	if tl.hostRejected(helloContext(hello), normalizeDomain(hello.ServerName)) == nil {
+		return nil, err
+	}
+	c, ok := hello.Conn.(*conn)
+	if !ok {
+		return nil, err
+	}
+	c.sniRejected.Store(true)
+	return tl.sniError.cert.Load(), nil
+}
+
+// acceptScreened returns the next connection that completed its handshake
+// with a certificate we can serve
+func (tl *TLSListener) acceptScreened() (net.Conn, error) {
+	if tl.isClosed() {
+		return nil, ErrListenerClosed
+	}
+
+	tl.sniError.screenOnce.Do(func() {
+		go tl.screenConns()
+	})
+
+	select {
+	case r := <-tl.sniError.screened:
+		return r.conn, r.err
+	case <-tl.sniError.screenDone:
+		return nil, ErrListenerClosed
+	}
+}
+
+// screenConns accepts connections and handshakes each in its own
+// goroutine, so a slow client never holds up the others
+func (tl *TLSListener) screenConns() {
+	defer close(tl.sniError.screenDone)
+
+	for {
+		tc, err := tl.acceptTLS()
+		if err == ErrListenerClosed {
+			return
+		}
+		if err != nil {
+			// Hand the error to Accept, which lets net/http back off
+			select {
+			case tl.sniError.screened <- acceptResult{err: err}:
+			case <-tl.done:
+				return
+			}
+			continue
+		}
+		go tl.screenConn(tc)
+	}
+}
+
+// screenConn completes tc's handshake and passes it on to Accept, or to
+// the error server if no certificate could be found for its SNI name
+func (tl *TLSListener) screenConn(tc *tls.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), screenHandshakeTimeout)
+	defer cancel()
+
+	err := tc.HandshakeContext(ctx)
+	tl.handshakeDone(tc, err)
+	if err != nil {
+		tc.Close()
+		return
+	}
+
+	if c, ok := tc.NetConn().(*conn); ok && c.sniRejected.Load() {
+		if !tl.sniError.listener.deliver(tc) {
+			tc.Close()
+		}
+		return
+	}
+
+	select {
+	case tl.sniError.screened <- acceptResult{conn: tc}:
+	case <-tl.sniError.screenDone:
+		tc.Close()
+	}
+}
+
+// chanListener is a net.Listener fed from a channel
+type chanListener struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newChanListener() *chanListener {
+	return &chanListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// deliver hands c to Accept, reporting false if the listener is closed
+func (l *chanListener) deliver(c net.Conn) bool {
+	select {
+	case l.conns <- c:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+func (l *chanListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *chanListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *chanListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
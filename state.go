@@ -0,0 +1,149 @@
+package tlslistener
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// stateVersion is the format version written by ExportState
+const stateVersion = 1
+
+// listenerState is the serialized form of the listener's non-socket state
+type listenerState struct {
+	Version         int                  `json:"version"`
+	Domain          string               `json:"domain"`
+	ExportedAt      time.Time            `json:"exportedAt"`
+	LastRenewal     map[string]time.Time `json:"lastRenewal,omitempty"`
+	IssuingCA       map[string]string    `json:"issuingCA,omitempty"`
+	CertDomains     []string             `json:"certDomains,omitempty"`
+	OrderedDomains  []string             `json:"orderedDomains,omitempty"`
+	DisabledDomains []string             `json:"disabledDomains,omitempty"`
+	AddedDomains    []string             `json:"addedDomains,omitempty"`
+	FileDomains     []string             `json:"fileDomains,omitempty"`
+	Stats           Stats                `json:"stats"`
+}
+
+// ExportState serializes the listener's runtime state: renewal times, the
+// issuing CA of each domain, which domains have certificates, domains
+// disabled or counted against MaxDomains, domains added with PrepareDomain
+// or read from DomainsFile, and the Stats counters. Passing the result as
+// Config.RestoreState to New carries it over a restart. Certificates
+// themselves live in the cache and are not included.
+//
+// DomainsFile stays the source of its domains: the restored ones are only
+// used if the file is configured and held none when New read it, e.g.
+// because it was caught mid-rewrite, until the file next changes.
+func (tl *TLSListener) ExportState() ([]byte, error) {
+	tl.mu.RLock()
+	st := listenerState{
+		Version:         stateVersion,
+		Domain:          tl.domain,
+		ExportedAt:      tl.now(),
+		LastRenewal:     make(map[string]time.Time, len(tl.lastRenewal)),
+		IssuingCA:       make(map[string]string, len(tl.issuingCA)),
+		CertDomains:     syncMapKeys(&tl.certDomains),
+		OrderedDomains:  setKeys(tl.orderedDomains),
+		DisabledDomains: setKeys(tl.disabledDomains),
+		AddedDomains:    append([]string(nil), tl.addedDomains...),
+		FileDomains:     append([]string(nil), tl.fileDomains...),
+	}
+	for domain, t := range tl.lastRenewal {
+		st.LastRenewal[domain] = t
+	}
+	for domain, ca := range tl.issuingCA {
+		st.IssuingCA[domain] = ca
+	}
+	tl.mu.RUnlock()
+	st.Stats = tl.Stats()
+
+	data, err := json.Marshal(st)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode listener state")
+	}
+	return data, nil
+}
+
+// restoreState loads state written by ExportState into a new listener
+func (tl *TLSListener) restoreState(data []byte) error {
+	var st listenerState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return errors.Wrap(err, "failed to decode listener state")
+	}
+	if st.Version != stateVersion {
+		return errors.Errorf("unsupported listener state version %d", st.Version)
+	}
+	if normalizeDomain(st.Domain) != normalizeDomain(tl.domain) {
+		return errors.Errorf("listener state belongs to %q, not %q", st.Domain, tl.domain)
+	}
+
+	tl.mu.Lock()
+	for domain, t := range st.LastRenewal {
+		tl.lastRenewal[normalizeDomain(domain)] = t
+	}
+	for domain, ca := range st.IssuingCA {
+		tl.issuingCA[normalizeDomain(domain)] = ca
+	}
+	for _, domain := range st.CertDomains {
+		tl.certDomains.Store(normalizeDomain(domain), true)
+	}
+	for _, domain := range st.OrderedDomains {
+		tl.orderedDomains[normalizeDomain(domain)] = true
+	}
+	for _, domain := range st.DisabledDomains {
+		tl.disabledDomains[normalizeDomain(domain)] = true
+	}
+	tl.anyDisabled.Store(len(tl.disabledDomains) > 0)
+	for _, domain := range st.AddedDomains {
+		tl.addedDomains = appendNew(tl.addedDomains, normalizeDomain(domain))
+	}
+	if tl.domainsFile != "" && len(tl.fileDomains) == 0 {
+		for _, domain := range st.FileDomains {
+			tl.fileDomains = appendNew(tl.fileDomains, normalizeDomain(domain))
+		}
+	}
+	tl.rebuildAllowedDomains()
+	tl.mu.Unlock()
+
+	tl.stats.accepted.Store(st.Stats.Accepted)
+	tl.stats.closed.Store(st.Stats.Closed)
+	tl.stats.acceptErrors.Store(st.Stats.AcceptErrors)
+	tl.stats.handshakeFailures.Store(st.Stats.HandshakeFailures)
+	return nil
+}
+
+// syncMapKeys returns the string keys of m in sorted order
+func syncMapKeys(m *sync.Map) []string {
+	var keys []string
+	m.Range(func(key, _ interface{}) bool {
+		keys = append(keys, key.(string))
+		return true
+	})
+	sort.Strings(keys)
+	return keys
+}
+
+// appendNew appends domain to domains unless it is already there
+func appendNew(domains []string, domain string) []string {
+	for _, d := range domains {
+		if d == domain {
+			return domains
+		}
+	}
+	return append(domains, domain)
+}
+
+// setKeys returns the members of set in sorted order
+func setKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key, ok := range set {
+		if ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,49 @@
+package tlslistener
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestStateCarriesRuntimeDomains(t *testing.T) {
+	dir := t.TempDir()
+	domainsFile := filepath.Join(dir, "domains")
+	if err := os.WriteFile(domainsFile, []byte("file.example.com\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := newTestListener(t, Config{DomainsFile: domainsFile})
+	old.addDomain("added.example.com")
+	state, err := old.ExportState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Close()
+
+	// Caught mid-rewrite, the file holds nothing at restart
+	if err := os.WriteFile(domainsFile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	restored := newTestListener(t, Config{DomainsFile: domainsFile, RestoreState: state})
+	if got, want := strings.Join(sortedDomains(restored), " "), "added.example.com example.com file.example.com"; got != want {
+		t.Fatalf("restored domains %q, want %q", got, want)
+	}
+
+	// A file with domains of its own stays authoritative for them
+	if err := os.WriteFile(domainsFile, []byte("new.example.com\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fresh := newTestListener(t, Config{DomainsFile: domainsFile, RestoreState: state})
+	if got, want := strings.Join(sortedDomains(fresh), " "), "added.example.com example.com new.example.com"; got != want {
+		t.Fatalf("restored domains %q, want %q", got, want)
+	}
+}
+
+// sortedDomains returns the domains tl serves in sorted order
+func sortedDomains(tl *TLSListener) []string {
+	domains := tl.domains()
+	sort.Strings(domains)
+	return domains
+}
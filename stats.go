@@ -0,0 +1,89 @@
+package tlslistener
+
+import (
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// Stats holds cumulative connection counters since the listener was created
+type Stats struct {
+	// Accepted is the number of connections from allowed clients accepted
+	// from the underlying listener. It includes connections then dropped
+	// before Accept returns them, for a bad PROXY header or by
+	// SNIErrorHandler screening, so it can exceed what callers received.
+	Accepted uint64
+	// Closed is the number of accepted connections that have been closed
+	Closed uint64
+	// AcceptErrors is the number of errors returned by the base listener
+	AcceptErrors uint64
+	// HandshakeFailures is the number of connections whose TLS handshake failed
+	HandshakeFailures uint64
+}
+
+// listenerStats is the atomic backing store for Stats
+type listenerStats struct {
+	accepted          atomic.Uint64
+	closed            atomic.Uint64
+	acceptErrors      atomic.Uint64
+	handshakeFailures atomic.Uint64
+}
+
+// Stats returns a snapshot of the listener's lifetime connection counters
+func (tl *TLSListener) Stats() Stats {
+	return Stats{
+		Accepted:          tl.stats.accepted.Load(),
+		Closed:            tl.stats.closed.Load(),
+		AcceptErrors:      tl.stats.acceptErrors.Load(),
+		HandshakeFailures: tl.stats.handshakeFailures.Load(),
+	}
+}
+
+// MetricsLabels returns a copy of Config.MetricsLabels, for tagging Stats
+// and Status when several listeners report to one collector
+func (tl *TLSListener) MetricsLabels() map[string]string {
+	if tl.metricsLabels == nil {
+		return nil
+	}
+	labels := make(map[string]string, len(tl.metricsLabels))
+	for k, v := range tl.metricsLabels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// DaysRemaining returns the fractional number of days until each allowed
+// domain's certificate expires, negative once it has, for a single metrics
+// scrape. Domains without a cached certificate are left out rather than
+// having one ordered. A domain whose certificate cannot be read is reported
+// in the returned error while the others are still returned.
+func (tl *TLSListener) DaysRemaining() (map[string]float64, error) {
+	days := make(map[string]float64)
+	failed := make(map[string]error)
+	now := tl.now()
+
+	for _, domain := range tl.domains() {
+		if tl.staticCert == nil && !tl.HasCachedCert(domain) {
+			continue
+		}
+		leaf, err := tl.LeafCertificate(domain)
+		if err != nil {
+			failed[domain] = err
+			continue
+		}
+		days[domain] = leaf.NotAfter.Sub(now).Hours() / 24
+	}
+
+	if len(failed) == 0 {
+		return days, nil
+	}
+	msgs := make([]string, 0, len(failed))
+	for domain, err := range failed {
+		msgs = append(msgs, domain+": "+err.Error())
+	}
+	sort.Strings(msgs)
+	return days, errors.Errorf("failed to read %d of %d certificates: %s",
+		len(failed), len(failed)+len(days), strings.Join(msgs, "; "))
+}
@@ -0,0 +1,59 @@
+package tlslistener
+
+// Status describes the listener's current state
+type Status struct {
+	// Domain is the primary domain
+	Domain string
+	// Listening reports whether the listener is accepting connections
+	Listening bool
+	// Draining reports whether Drain has been called but Close has not
+	Draining bool
+	// CertDir is the directory certificates are cached in
+	CertDir string
+	// CacheWriteError is the last failed cache write, or nil if the most
+	// recent write succeeded
+	CacheWriteError error
+	// CacheWriteFailures counts consecutive failed cache writes
+	CacheWriteFailures int
+	// DiskFreeBytes is the space available to unprivileged users on the
+	// filesystem holding CertDir, or -1 if it cannot be determined
+	DiskFreeBytes int64
+	// IssuingCA is the ACME directory URL the primary domain's certificate
+	// was last issued from by this listener, or empty if it has not been
+	// renewed since startup
+	IssuingCA string
+	// RenewalPaused reports whether PauseRenewal is in effect
+	RenewalPaused bool
+	// Labels are the listener's MetricsLabels
+	Labels map[string]string
+	// ServingExpired reports whether an expired certificate was served in
+	// the last ten minutes
+	ServingExpired bool
+}
+
+// Status returns a snapshot of the listener's current state
+func (tl *TLSListener) Status() Status {
+	tl.mu.RLock()
+	st := Status{
+		Domain:    tl.domain,
+		Listening: tl.listener != nil && !tl.draining,
+		Draining:  tl.listener != nil && tl.draining,
+		CertDir:   tl.certDir,
+		IssuingCA: tl.issuingCA[normalizeDomain(tl.domain)],
+	}
+	tl.mu.RUnlock()
+	st.RenewalPaused = tl.renewalPaused.Load()
+	st.Labels = tl.MetricsLabels()
+	st.ServingExpired = tl.servingExpired()
+
+	tl.cacheHealth.mu.Lock()
+	st.CacheWriteError = tl.cacheHealth.lastErr
+	st.CacheWriteFailures = tl.cacheHealth.failures
+	tl.cacheHealth.mu.Unlock()
+
+	st.DiskFreeBytes = -1
+	if free, err := diskFree(st.CertDir); err == nil {
+		st.DiskFreeBytes = free
+	}
+	return st
+}
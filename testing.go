@@ -0,0 +1,31 @@
+package tlslistener
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+
+	"github.com/pkg/errors"
+)
+
+// NewForTesting creates a TLSListener that obtains certificates from a test
+// ACME server such as pebble. caCert is the PEM-encoded certificate of the
+// CA serving the ACME API (pebble's minica root), which is trusted only for
+// ACME requests. If cfg has neither Cache nor CertDir, certificates are kept
+// in memory, so every run starts from a clean slate.
+func NewForTesting(directoryURL string, caCert []byte, cfg Config) (*TLSListener, error) {
+	if directoryURL == "" {
+		return nil, errors.New("directory URL is required")
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caCert) {
+		return nil, errors.New("failed to parse ACME server CA certificate")
+	}
+
+	cfg.DirectoryURL = directoryURL
+	cfg.ACMETLSConfig = &tls.Config{RootCAs: roots}
+	if cfg.Cache == nil && cfg.CertDir == "" {
+		cfg.Cache = newMemoryCache()
+	}
+	return New(cfg)
+}
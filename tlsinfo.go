@@ -0,0 +1,95 @@
+package tlslistener
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// TLSConfigInfo is a read-only description of the TLS configuration the
+// listener serves with
+type TLSConfigInfo struct {
+	// MinVersion and MaxVersion are the accepted protocol versions, as
+	// names such as "TLS 1.2"; an empty MaxVersion means the newest
+	// version crypto/tls supports
+	MinVersion string
+	MaxVersion string
+	// CipherSuites names the configured TLS 1.0-1.2 cipher suites; empty
+	// means crypto/tls defaults. TLS 1.3 suites are not configurable.
+	CipherSuites []string
+	// NextProtos lists the ALPN protocols advertised, in preference order
+	NextProtos []string
+	// ClientAuth is the client certificate policy, e.g. "NoClientCert"
+	ClientAuth string
+	// SessionTicketsDisabled reports whether DisableSessionTickets is set.
+	// It applies to TLS 1.2 handshakes only; TLS 1.3 keeps its tickets.
+	SessionTicketsDisabled bool
+}
+
+// TLSConfigSnapshot describes the effective TLS configuration. It returns
+// copies rather than the live *tls.Config, so it cannot be used to mutate
+// the configuration by accident.
+func (tl *TLSListener) TLSConfigSnapshot() TLSConfigInfo {
+	tl.mu.RLock()
+	cfg := tl.tlsConfig
+	tl.mu.RUnlock()
+
+	if cfg == nil {
+		return TLSConfigInfo{}
+	}
+
+	info := TLSConfigInfo{
+		MinVersion:             tls.VersionName(cfg.MinVersion),
+		NextProtos:             append([]string(nil), cfg.NextProtos...),
+		ClientAuth:             cfg.ClientAuth.String(),
+		SessionTicketsDisabled: tl.disableTickets,
+	}
+	if cfg.MaxVersion != 0 {
+		info.MaxVersion = tls.VersionName(cfg.MaxVersion)
+	}
+	for _, id := range cfg.CipherSuites {
+		info.CipherSuites = append(info.CipherSuites, tls.CipherSuiteName(id))
+	}
+	return info
+}
+
+// NegotiatedVersion returns the TLS version negotiated on c, a connection
+// returned by Accept or a wrapper of one. ok is false for connections that
+// are not TLS or have not completed their handshake.
+func NegotiatedVersion(c net.Conn) (version uint16, ok bool) {
+	state, ok := connectionState(c)
+	return state.Version, ok
+}
+
+// NegotiatedCipherSuite returns the cipher suite negotiated on c, as
+// described for NegotiatedVersion. tls.CipherSuiteName gives its name.
+func NegotiatedCipherSuite(c net.Conn) (suite uint16, ok bool) {
+	state, ok := connectionState(c)
+	return state.CipherSuite, ok
+}
+
+// connectionState returns the state of the completed handshake of the
+// *tls.Conn in or beneath c
+func connectionState(c net.Conn) (tls.ConnectionState, bool) {
+	tc := tlsConn(c)
+	if tc == nil {
+		return tls.ConnectionState{}, false
+	}
+	state := tc.ConnectionState()
+	return state, state.HandshakeComplete
+}
+
+// tlsConn finds the *tls.Conn in c, unwrapping connections that expose the
+// one beneath them through a NetConn method, as tls.Conn itself does
+func tlsConn(c net.Conn) *tls.Conn {
+	for c != nil {
+		if tc, ok := c.(*tls.Conn); ok {
+			return tc
+		}
+		u, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		c = u.NetConn()
+	}
+	return nil
+}
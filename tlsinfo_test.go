@@ -0,0 +1,14 @@
+package tlslistener
+
+import "testing"
+
+func TestTLSConfigSnapshotReportsDisabledTickets(t *testing.T) {
+	tl := newTestListener(t, Config{Certificate: testCert(t, testDomain), DisableSessionTickets: true})
+	if !tl.TLSConfigSnapshot().SessionTicketsDisabled {
+		t.Fatal("snapshot does not report DisableSessionTickets")
+	}
+	tl = newTestListener(t, Config{Certificate: testCert(t, testDomain)})
+	if tl.TLSConfigSnapshot().SessionTicketsDisabled {
+		t.Fatal("snapshot reports tickets disabled by default")
+	}
+}
@@ -0,0 +1,49 @@
+package tlslistener
+
+import (
+	"crypto/tls"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// validateCacheEntry runs Config.ValidateCertificate on a certificate about
+// to be cached under key. Every certificate autocert or the renewal path
+// obtains passes through the cache, so this sees each issuance. Entries
+// that are not certificates, challenge certificates and archived copies
+// are skipped.
+func (tl *TLSListener) validateCacheEntry(key string, data []byte) error {
+	if tl.validateCert == nil || strings.HasSuffix(key, "+token") || strings.Contains(key, oldCertMarker) {
+		return nil
+	}
+	cert, err := parseCacheEntry(data)
+	if err != nil {
+		return nil
+	}
+
+	err = tl.validateCert(cert.Leaf)
+	if err == nil {
+		return nil
+	}
+	err = errors.Wrapf(err, "certificate for %s (serial %s) failed validation", key, cert.Leaf.SerialNumber)
+	tl.logf("WARNING: %v", err)
+	tl.renewError(key, err)
+
+	if tl.blockInvalid {
+		tl.mu.Lock()
+		tl.rejectedSerials[cert.Leaf.SerialNumber.String()] = true
+		tl.mu.Unlock()
+	}
+	return err
+}
+
+// certRejected reports whether cert failed ValidateCertificate and
+// BlockInvalidCertificates keeps it from being served
+func (tl *TLSListener) certRejected(cert *tls.Certificate) bool {
+	if !tl.blockInvalid || cert == nil || cert.Leaf == nil {
+		return false
+	}
+	tl.mu.RLock()
+	defer tl.mu.RUnlock()
+	return tl.rejectedSerials[cert.Leaf.SerialNumber.String()]
+}